@@ -0,0 +1,387 @@
+package campaigns
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/zarinit-routers/cloud-connector/config"
+	"github.com/zarinit-routers/cloud-connector/connections"
+	"github.com/zarinit-routers/cloud-connector/fanout"
+	"github.com/zarinit-routers/cloud-connector/models"
+	"github.com/zarinit-routers/cloud-connector/storage/repository"
+	"github.com/zarinit-routers/cloud-connector/tracker"
+)
+
+const (
+	ENV_CAMPAIGN_RESUME_DELAY = "CAMPAIGN_RESUME_DELAY"
+	ENV_CAMPAIGN_LEASE        = "CAMPAIGN_LEASE"
+)
+
+var (
+	ErrBadState     = errors.New("not allowed in the current campaign state")
+	ErrNoNodes      = errors.New("no nodes selected")
+	ErrBadWaves     = errors.New("wave sizes must be positive")
+	ErrBadThreshold = errors.New("success threshold must be between 0 and 1")
+)
+
+var (
+	clog = log.WithPrefix("Campaigns")
+
+	// runners holds campaigns executed by this instance
+	mu      sync.Mutex
+	runners = map[models.UUID]bool{}
+
+	// owner identifies this instance in campaign leases
+	owner = uuid.NewString()
+)
+
+func getResumeDelay() time.Duration {
+	return config.Duration(ENV_CAMPAIGN_RESUME_DELAY, time.Minute)
+}
+
+func getLease() time.Duration {
+	return config.Duration(ENV_CAMPAIGN_LEASE, time.Minute)
+}
+
+// Create selects the nodes and stores the campaign, it is started separately.
+func Create(selector *models.Selector, name string, command string, args models.JsonMap, timeoutSeconds int, waveSizes []int, successThreshold float64, pauseOnFailure bool) (*repository.Campaign, error) {
+	if len(waveSizes) == 0 {
+		return nil, ErrBadWaves
+	}
+	for _, size := range waveSizes {
+		if size <= 0 {
+			return nil, ErrBadWaves
+		}
+	}
+	if successThreshold < 0 || successThreshold > 1 {
+		return nil, ErrBadThreshold
+	}
+
+	organizationID, err := selector.ParseOrganizationID()
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := fanout.Select(selector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select nodes: %s", err)
+	}
+	if len(nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+	nodeIDs := make([]models.UUID, 0, len(nodes))
+	for _, node := range nodes {
+		nodeIDs = append(nodeIDs, node.ID)
+	}
+
+	return repository.NewCampaign(organizationID, name, command, args, timeoutSeconds, selector.Tag, waveSizes, successThreshold, pauseOnFailure, nodeIDs)
+}
+
+func Start(id models.UUID) error {
+	ok, err := repository.UpdateCampaignState(id, []string{repository.CampaignStateCreated}, repository.CampaignStateRunning, map[string]any{
+		"started_at": time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrBadState
+	}
+	clog.Info("Campaign started", "campaignId", id)
+	go run(id)
+	return nil
+}
+
+// Pause stops the campaign after the current wave.
+func Pause(id models.UUID) error {
+	ok, err := repository.UpdateCampaignState(id, []string{repository.CampaignStateRunning}, repository.CampaignStatePaused, map[string]any{
+		"pause_reason": "paused by user",
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrBadState
+	}
+	clog.Info("Campaign paused", "campaignId", id)
+	return nil
+}
+
+func Resume(id models.UUID) error {
+	ok, err := repository.UpdateCampaignState(id, []string{repository.CampaignStatePaused}, repository.CampaignStateRunning, map[string]any{
+		"pause_reason": "",
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrBadState
+	}
+	clog.Info("Campaign resumed", "campaignId", id)
+	go run(id)
+	return nil
+}
+
+// Abort stops the campaign for good, nodes not reached yet are skipped.
+func Abort(id models.UUID) error {
+	from := []string{repository.CampaignStateCreated, repository.CampaignStateRunning, repository.CampaignStatePaused}
+	ok, err := repository.UpdateCampaignState(id, from, repository.CampaignStateAborted, map[string]any{
+		"finished_at": time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrBadState
+	}
+	if err := repository.SetCampaignNodesState(id, repository.CampaignNodeStatePending, repository.CampaignNodeStateSkipped); err != nil {
+		clog.Error("Failed to skip campaign nodes", "error", err, "campaignId", id)
+	}
+	clog.Info("Campaign aborted", "campaignId", id)
+	return nil
+}
+
+// ServeRunning continues campaigns left running by a previous start of the
+// connector or by another instance that went away, once nodes had time to
+// connect again. Campaigns are checked every resume delay, the lease lets
+// only one instance run each of them.
+func ServeRunning() {
+	ticker := time.NewTicker(getResumeDelay())
+	defer ticker.Stop()
+	for range ticker.C {
+		resumeRunning()
+	}
+}
+
+func resumeRunning() {
+	campaigns, err := repository.GetCampaignsByState(repository.CampaignStateRunning)
+	if err != nil {
+		clog.Error("Failed get running campaigns", "error", err)
+		return
+	}
+	for _, campaign := range campaigns {
+		go run(campaign.ID)
+	}
+}
+
+// keepLease renews the lease of the campaign until stop is closed. It closes
+// lost when another instance took the lease or the lease ran out before it
+// could be renewed.
+func keepLease(id models.UUID, until time.Time, stop <-chan struct{}, lost chan<- struct{}) {
+	ticker := time.NewTicker(getLease() / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			next := time.Now().Add(getLease())
+			ok, err := repository.ClaimCampaign(id, owner, next)
+			if err != nil {
+				clog.Error("Failed to renew campaign lease", "error", err, "campaignId", id)
+				if time.Now().Before(until) {
+					continue
+				}
+			} else if ok {
+				until = next
+				continue
+			}
+			clog.Error("Campaign lease lost", "campaignId", id)
+			close(lost)
+			return
+		}
+	}
+}
+
+func isLost(lost <-chan struct{}) bool {
+	select {
+	case <-lost:
+		return true
+	default:
+		return false
+	}
+}
+
+func waveSize(sizes []int, wave int) int {
+	return sizes[min(wave, len(sizes)-1)]
+}
+
+// run executes waves until the campaign is done or is not running anymore.
+// It returns right away when another instance holds the campaign lease.
+func run(id models.UUID) {
+	mu.Lock()
+	if runners[id] {
+		mu.Unlock()
+		return
+	}
+	runners[id] = true
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		delete(runners, id)
+		mu.Unlock()
+	}()
+
+	until := time.Now().Add(getLease())
+	ok, err := repository.ClaimCampaign(id, owner, until)
+	if err != nil {
+		clog.Error("Failed to claim campaign", "error", err, "campaignId", id)
+		return
+	}
+	if !ok {
+		return
+	}
+	clog.Info("Running campaign", "campaignId", id, "owner", owner)
+	stop := make(chan struct{})
+	lost := make(chan struct{})
+	go keepLease(id, until, stop, lost)
+	defer func() {
+		close(stop)
+		if err := repository.ReleaseCampaign(id, owner); err != nil {
+			clog.Error("Failed to release campaign", "error", err, "campaignId", id)
+		}
+	}()
+
+	// Nodes of a wave interrupted by a crash never got their result, they
+	// are tried again
+	if err := repository.SetCampaignNodesState(id, repository.CampaignNodeStateSent, repository.CampaignNodeStatePending); err != nil {
+		clog.Error("Failed to reset campaign nodes", "error", err, "campaignId", id)
+		return
+	}
+
+	for {
+		// Another instance runs the campaign now
+		if isLost(lost) {
+			return
+		}
+		campaign, err := repository.GetCampaign(id)
+		if err != nil {
+			clog.Error("Failed get campaign", "error", err, "campaignId", id)
+			return
+		}
+		if campaign.State != repository.CampaignStateRunning {
+			return
+		}
+		if !runWave(campaign, lost) {
+			return
+		}
+	}
+}
+
+// runWave sends the command to the next wave of connected nodes and checks
+// the success threshold. It returns false when the campaign stopped or the
+// lease was lost, outcomes of a wave finished after that are not written.
+func runWave(campaign *repository.Campaign, lost <-chan struct{}) bool {
+	running := []string{repository.CampaignStateRunning}
+
+	pending, err := repository.GetCampaignNodes(campaign.ID, repository.CampaignNodeStatePending, -1, -1)
+	if err != nil {
+		clog.Error("Failed get pending campaign nodes", "error", err, "campaignId", campaign.ID)
+		return false
+	}
+	size := waveSize(campaign.WaveSizes.Val, campaign.CurrentWave)
+	wave := []repository.Node{}
+	for _, node := range pending {
+		if len(wave) == size {
+			break
+		}
+		if connections.IsConnected(node.NodeID) {
+			wave = append(wave, repository.Node{ModelBase: &repository.ModelBase{ID: node.NodeID}})
+		}
+	}
+
+	if len(pending) == 0 {
+		if _, err := repository.UpdateCampaignState(campaign.ID, running, repository.CampaignStateCompleted, map[string]any{"finished_at": time.Now()}); err != nil {
+			clog.Error("Failed to update campaign", "error", err, "campaignId", campaign.ID)
+		}
+		clog.Info("Campaign completed", "campaignId", campaign.ID)
+		return false
+	}
+	// Nothing was run, the campaign waits for the nodes to connect
+	if len(wave) == 0 {
+		reason := fmt.Sprintf("wave %d: all %d pending nodes are offline", campaign.CurrentWave, len(pending))
+		if _, err := repository.UpdateCampaignState(campaign.ID, running, repository.CampaignStatePaused, map[string]any{"pause_reason": reason}); err != nil {
+			clog.Error("Failed to update campaign", "error", err, "campaignId", campaign.ID)
+		}
+		clog.Warn("Campaign paused, nodes are offline", "campaignId", campaign.ID, "reason", reason)
+		return false
+	}
+
+	for _, node := range wave {
+		if err := repository.UpdateCampaignNode(campaign.ID, node.ID, repository.CampaignNodeStateSent, campaign.CurrentWave, "", "", nil); err != nil {
+			clog.Error("Failed to update campaign node", "error", err, "campaignId", campaign.ID, "nodeId", node.ID)
+		}
+	}
+	clog.Info("Running campaign wave", "campaignId", campaign.ID, "wave", campaign.CurrentWave, "nodes", len(wave))
+
+	timeout := tracker.Timeout(campaign.Command, time.Duration(campaign.TimeoutSeconds)*time.Second)
+	result := fanout.Call(wave, campaign.Command, campaign.Args.Val, timeout)
+	if isLost(lost) {
+		clog.Warn("Campaign lease lost during the wave, outcomes are dropped", "campaignId", campaign.ID, "wave", campaign.CurrentWave)
+		return false
+	}
+
+	for _, nodeResult := range result.Results {
+		state := repository.CampaignNodeStateSucceeded
+		if nodeResult.RequestError != "" || nodeResult.CommandError != "" {
+			state = repository.CampaignNodeStateFailed
+		}
+		if err := repository.UpdateCampaignNode(campaign.ID, nodeResult.NodeID, state, campaign.CurrentWave, nodeResult.RequestError, nodeResult.CommandError, nodeResult.Data); err != nil {
+			clog.Error("Failed to update campaign node", "error", err, "campaignId", campaign.ID, "nodeId", nodeResult.NodeID)
+		}
+	}
+	// Nodes gone before the command was sent are tried again in later waves
+	for _, nodeID := range result.Offline {
+		if err := repository.UpdateCampaignNode(campaign.ID, nodeID, repository.CampaignNodeStatePending, campaign.CurrentWave, "", "", nil); err != nil {
+			clog.Error("Failed to update campaign node", "error", err, "campaignId", campaign.ID, "nodeId", nodeID)
+		}
+	}
+	// Abort skips pending nodes, nodes put back after an abort during the wave
+	// are skipped here
+	if current, err := repository.GetCampaign(campaign.ID); err == nil && current.State == repository.CampaignStateAborted {
+		if err := repository.SetCampaignNodesState(campaign.ID, repository.CampaignNodeStatePending, repository.CampaignNodeStateSkipped); err != nil {
+			clog.Error("Failed to skip campaign nodes", "error", err, "campaignId", campaign.ID)
+		}
+		return false
+	}
+
+	fields := map[string]any{
+		"current_wave": campaign.CurrentWave + 1,
+	}
+	attempted := len(result.Results)
+	if attempted > 0 && float64(result.Succeeded)/float64(attempted) < campaign.SuccessThreshold {
+		fields["pause_reason"] = fmt.Sprintf("wave %d: %d of %d nodes succeeded, threshold is %g", campaign.CurrentWave, result.Succeeded, attempted, campaign.SuccessThreshold)
+		if campaign.PauseOnFailure {
+			if _, err := repository.UpdateCampaignState(campaign.ID, running, repository.CampaignStatePaused, fields); err != nil {
+				clog.Error("Failed to update campaign", "error", err, "campaignId", campaign.ID)
+			}
+			clog.Warn("Campaign paused on failures", "campaignId", campaign.ID, "reason", fields["pause_reason"])
+			return false
+		}
+		fields["finished_at"] = time.Now()
+		if _, err := repository.UpdateCampaignState(campaign.ID, running, repository.CampaignStateFailed, fields); err != nil {
+			clog.Error("Failed to update campaign", "error", err, "campaignId", campaign.ID)
+		}
+		if err := repository.SetCampaignNodesState(campaign.ID, repository.CampaignNodeStatePending, repository.CampaignNodeStateSkipped); err != nil {
+			clog.Error("Failed to skip campaign nodes", "error", err, "campaignId", campaign.ID)
+		}
+		clog.Error("Campaign failed", "campaignId", campaign.ID, "reason", fields["pause_reason"])
+		return false
+	}
+
+	// The campaign may have been paused during the wave, the wave is done anyway
+	for _, state := range []string{repository.CampaignStateRunning, repository.CampaignStatePaused} {
+		ok, err := repository.UpdateCampaignState(campaign.ID, []string{state}, state, fields)
+		if err != nil {
+			clog.Error("Failed to update campaign", "error", err, "campaignId", campaign.ID)
+			return false
+		}
+		if ok {
+			break
+		}
+	}
+	return true
+}
@@ -2,16 +2,28 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/zarinit-routers/cloud-connector/campaigns"
 	"github.com/zarinit-routers/cloud-connector/connections"
+	"github.com/zarinit-routers/cloud-connector/deferred"
+	"github.com/zarinit-routers/cloud-connector/dispatch"
+	"github.com/zarinit-routers/cloud-connector/fanout"
+	"github.com/zarinit-routers/cloud-connector/jobs"
 	"github.com/zarinit-routers/cloud-connector/models"
 	"github.com/zarinit-routers/cloud-connector/queue"
+	"github.com/zarinit-routers/cloud-connector/scheduler"
 	"github.com/zarinit-routers/cloud-connector/server"
 	"github.com/zarinit-routers/cloud-connector/storage/database"
+	"github.com/zarinit-routers/cloud-connector/storage/repository"
+	"github.com/zarinit-routers/cloud-connector/tracker"
+	"github.com/zarinit-routers/cloud-connector/transfer"
 )
 
 func main() {
@@ -42,8 +54,41 @@ func main() {
 	}()
 
 	queue.AddHandler(queueHandler)
+	queue.AddDeadLetterHandler(deadLetterHandler)
 
 	connections.AddHandler(websocketHandler)
+	connections.AddConnectHandler(connectHandler)
+	connections.AddDisconnectHandler(disconnectHandler)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		deferred.ServeExpiry(replyToCloud)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		jobs.ServeExpiry()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		jobs.ServeQueued()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		campaigns.ServeRunning()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		scheduler.Serve()
+	}()
 
 	wg.Wait()
 }
@@ -55,21 +100,64 @@ var (
 
 func queueHandler(m *amqp.Delivery) error {
 	requestId := m.CorrelationId
+	route := queue.RouteOf(m)
+
+	qlog.Info("New message", "requestId", requestId, "replyTo", route.ReplyTo, "body", string(m.Body))
 
-	qlog.Info("New message", "requestId", requestId, "body", string(m.Body))
+	if requestId == "" {
+		qlog.Error("Message without correlation id")
+		return queue.DeadLetter(queue.ReasonMissingCorrelationID, fmt.Errorf("correlation id not specified"))
+	}
 
 	var cloudRequest models.FromCloudRequest
 	if err := json.Unmarshal(m.Body, &cloudRequest); err != nil {
 		qlog.Error("Failed to unmarshal message", "error", err)
-		return err
+		return queue.DeadLetter(queue.ReasonMalformed, queue.BadRequestBodyErr(err))
 	}
 
 	if err := cloudRequest.Validate(); err != nil {
 		qlog.Error("Failed validate request from cloud", "error", err, "requestId", requestId)
-		return fmt.Errorf("failed validate request from cloud: %s", err)
+		return queue.DeadLetter(queue.ReasonInvalid, fmt.Errorf("failed validate request from cloud: %s", err))
 	}
 
-	if err := connections.SendRequest(cloudRequest.NodeID, cloudRequest.ToNode(requestId)); err != nil {
+	if cloudRequest.Selector != nil {
+		route.Command = cloudRequest.Command
+		return fanoutRequest(route, &cloudRequest)
+	}
+
+	nodeId, err := cloudRequest.ParseNodeID()
+	if err != nil {
+		qlog.Error("Failed validate request from cloud", "error", err, "requestId", requestId)
+		return queue.DeadLetter(queue.ReasonInvalid, fmt.Errorf("failed validate request from cloud: %s", err))
+	}
+
+	route.NodeID = nodeId
+	route.Command = cloudRequest.Command
+
+	err = dispatchRequest(route, nodeId, &cloudRequest)
+	if errors.Is(err, tracker.ErrDuplicateRequestID) {
+		// Redelivered after a broker reconnect, the first delivery is in
+		// flight and replies on its own
+		qlog.Warn("Request is already pending, ignoring redelivery", "requestId", requestId, "nodeId", nodeId)
+		return nil
+	}
+	if errors.Is(err, connections.ErrNotConnected) && queue.CanRequeue(m) {
+		// The node may be connected to another connector instance
+		qlog.Warn("Node is not connected to this instance, requeueing request", "requestId", requestId, "nodeId", nodeId, "requeueCount", queue.RequeueCount(m))
+		return queue.Requeue(err)
+	}
+	if errors.Is(err, connections.ErrNotConnected) && cloudRequest.Deferrable {
+		if err := deferred.Store(route, nodeId, &cloudRequest); err != nil {
+			qlog.Error("Failed to defer request", "error", err, "requestId", requestId)
+			return err
+		}
+		// The node may have connected while the request was being stored
+		if session, ok := connections.GetSession(nodeId); ok {
+			deferred.Flush(session, dispatchRequest, replyToCloud)
+		}
+		return nil
+	}
+	if err != nil {
 		qlog.Error("Failed to send request", "error", err)
 		return err
 	}
@@ -77,19 +165,88 @@ func queueHandler(m *amqp.Delivery) error {
 	return nil
 }
 
-func websocketHandler(body []byte) error {
-	var response models.FromNodeResponse
-	if err := json.Unmarshal(body, &response); err != nil {
-		wsLog.Error("Failed to unmarshal message", "error", err)
-		return err
+func deadLetterHandler(m *amqp.Delivery, reason string, err error) {
+	if _, err := repository.NewDeadLetter(m.CorrelationId, m.ReplyTo, reason, err.Error(), m.Body, m.ContentType); err != nil {
+		qlog.Error("Failed to store dead letter", "error", err, "requestId", m.CorrelationId)
 	}
+}
 
-	wsLog.Info("New message", "requestId", response.RequestID)
+// dispatchRequest sends a request from the cloud to the node, the response
+// is published to the route of the request.
+func dispatchRequest(route queue.Route, nodeId models.UUID, cloudRequest *models.FromCloudRequest) error {
+	if session, ok := connections.GetSession(nodeId); ok {
+		route.OrganizationID = session.OrganizationID()
+	}
+	return dispatch.SendStream(route.RequestID, nodeId, cloudRequest.Command, cloudRequest.Args, cloudRequest.Timeout(), cloudRequest.Stream, partToCloud(route), replyToCloud(route))
+}
 
-	if err := queue.SendResponse(response.RequestID, response.ToCloud()); err != nil {
-		wsLog.Error("Failed to send response", "error", err)
+// fanoutRequest sends the request to every selected node connected to this
+// instance and replies one response aggregating their results.
+func fanoutRequest(route queue.Route, cloudRequest *models.FromCloudRequest) error {
+	nodes, err := fanout.Select(cloudRequest.Selector)
+	if err != nil {
+		qlog.Error("Failed select nodes", "error", err, "requestId", route.RequestID)
 		return err
 	}
-	wsLog.Info("Message handled", "requestId", response.RequestID)
+	if organizationId, _ := cloudRequest.Selector.ParseOrganizationID(); organizationId != nil {
+		route.OrganizationID = *organizationId
+	}
+
+	timeout := tracker.Timeout(cloudRequest.Command, cloudRequest.Timeout())
+	fanout.Run(nodes, cloudRequest.Command, cloudRequest.Args, timeout, func(result *fanout.Result) {
+		qlog.Info("Fan-out finished", "requestId", route.RequestID, "total", result.Total, "succeeded", result.Succeeded, "failed", result.Failed, "offline", len(result.Offline))
+		replyToCloud(route)(result.ToCloud())
+	})
 	return nil
 }
+
+func replyToCloud(route queue.Route) tracker.ReplyFunc {
+	return func(response *models.ToCloudResponse) {
+		if route.OrganizationID == uuid.Nil && route.NodeID != uuid.Nil {
+			if node, err := repository.GetNode(route.NodeID); err == nil {
+				route.OrganizationID = node.OrganizationID
+			}
+		}
+		if err := queue.SendResponse(route, response); err != nil {
+			qlog.Error("Failed to send response", "error", err, "requestId", route.RequestID, "replyTo", route.ReplyTo)
+		}
+	}
+}
+
+func partToCloud(route queue.Route) tracker.PartFunc {
+	return func(seq int, final bool, response *models.ToCloudResponse) {
+		if err := queue.SendResponsePart(route, seq, final, response); err != nil {
+			qlog.Error("Failed to send response part", "error", err, "requestId", route.RequestID, "seq", seq)
+		}
+	}
+}
+
+func connectHandler(session *connections.Session) {
+	publishPresence(session, models.EventNodeConnected)
+	deferred.Flush(session, dispatchRequest, replyToCloud)
+	jobs.Flush(session)
+	transfer.Resume(session)
+}
+
+func disconnectHandler(session *connections.Session) {
+	publishPresence(session, models.EventNodeDisconnected)
+	transfer.Suspend(session)
+}
+
+func publishPresence(session *connections.Session, eventType string) {
+	event := &models.NodePresenceEvent{
+		Type:           eventType,
+		NodeID:         session.NodeID(),
+		OrganizationID: session.OrganizationID(),
+		RemoteAddress:  session.RemoteAddr,
+		ConnectedAt:    session.ConnectedAt,
+		Timestamp:      time.Now(),
+	}
+	if closedAt := session.ClosedAt(); !closedAt.IsZero() {
+		event.DisconnectedAt = &closedAt
+		event.Reason = session.CloseReason()
+	}
+	if err := queue.PublishPresence(event); err != nil {
+		wsLog.Error("Failed to publish presence event", "error", err, "nodeId", session.NodeID(), "event", eventType)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/zarinit-routers/cloud-connector/connections"
+	"github.com/zarinit-routers/cloud-connector/jobs"
+	"github.com/zarinit-routers/cloud-connector/models"
+	"github.com/zarinit-routers/cloud-connector/queue"
+	"github.com/zarinit-routers/cloud-connector/tracker"
+	"github.com/zarinit-routers/cloud-connector/transfer"
+	"github.com/zarinit-routers/cloud-connector/tunnel"
+)
+
+func websocketHandler(session *connections.Session, body []byte) error {
+	messageType, err := models.ParseMessageType(session.Codec(), body)
+	if err != nil {
+		wsLog.Error("Failed to unmarshal message", "error", err, "nodeId", session.NodeID())
+		return err
+	}
+
+	switch messageType {
+	case models.MessageTypeResponse:
+		return handleNodeResponse(session, body)
+	case models.MessageTypeEvent:
+		return handleNodeEvent(session, body)
+	case models.MessageTypeChunk:
+		return handleNodeChunk(session, body)
+	case models.MessageTypeProgress:
+		return handleNodeProgress(session, body)
+	}
+	if models.IsFileMessage(messageType) {
+		return handleNodeFile(session, body)
+	}
+	if models.IsTunnelMessage(messageType) {
+		return handleNodeTunnel(session, body)
+	}
+	wsLog.Warn("Dropping message of unknown type", "type", messageType, "nodeId", session.NodeID())
+	return nil
+}
+
+func handleNodeResponse(session *connections.Session, body []byte) error {
+	var response models.FromNodeResponse
+	if err := session.Codec().Unmarshal(body, &response); err != nil {
+		wsLog.Error("Failed to unmarshal message", "error", err)
+		return err
+	}
+
+	wsLog.Info("New message", "requestId", response.RequestID, "nodeId", session.NodeID())
+
+	if !tracker.Resolve(response.RequestID, session.NodeID(), response.ToCloud()) {
+		wsLog.Warn("Dropping response to unknown or expired request", "requestId", response.RequestID, "nodeId", session.NodeID())
+		return nil
+	}
+	wsLog.Info("Message handled", "requestId", response.RequestID)
+	return nil
+}
+
+func handleNodeEvent(session *connections.Session, body []byte) error {
+	var event models.FromNodeEvent
+	if err := session.Codec().Unmarshal(body, &event); err != nil {
+		wsLog.Error("Failed to unmarshal event", "error", err)
+		return err
+	}
+
+	if err := event.Validate(); err != nil {
+		wsLog.Warn("Dropping invalid event", "error", err, "nodeId", session.NodeID())
+		return nil
+	}
+
+	if err := queue.PublishNodeEvent(event.ToCloud(session.NodeID(), session.OrganizationID())); err != nil {
+		wsLog.Error("Failed to publish event", "error", err, "event", event.Event, "nodeId", session.NodeID())
+		return err
+	}
+	wsLog.Info("Event published", "event", event.Event, "nodeId", session.NodeID())
+	return nil
+}
+
+func handleNodeChunk(session *connections.Session, body []byte) error {
+	var chunk models.FromNodeChunk
+	if err := session.Codec().Unmarshal(body, &chunk); err != nil {
+		wsLog.Error("Failed to unmarshal chunk", "error", err)
+		return err
+	}
+
+	if err := chunk.Validate(); err != nil {
+		wsLog.Warn("Dropping invalid chunk", "error", err, "nodeId", session.NodeID())
+		return nil
+	}
+
+	if !tracker.Chunk(session.NodeID(), &chunk) {
+		wsLog.Warn("Dropping chunk of unknown or expired request", "requestId", chunk.RequestID, "seq", chunk.Seq, "nodeId", session.NodeID())
+	}
+	return nil
+}
+
+func handleNodeProgress(session *connections.Session, body []byte) error {
+	var progress models.FromNodeProgress
+	if err := session.Codec().Unmarshal(body, &progress); err != nil {
+		wsLog.Error("Failed to unmarshal progress", "error", err)
+		return err
+	}
+
+	if err := progress.Validate(); err != nil {
+		wsLog.Warn("Dropping invalid progress", "error", err, "nodeId", session.NodeID())
+		return nil
+	}
+
+	if !tracker.Extend(progress.RequestID, session.NodeID()) {
+		wsLog.Warn("Dropping progress of unknown or expired request", "requestId", progress.RequestID, "nodeId", session.NodeID())
+		return nil
+	}
+	jobs.Progress(session.NodeID(), &progress)
+	return nil
+}
+
+func handleNodeFile(session *connections.Session, body []byte) error {
+	var message models.FromNodeFile
+	if err := session.Codec().Unmarshal(body, &message); err != nil {
+		wsLog.Error("Failed to unmarshal file message", "error", err)
+		return err
+	}
+
+	if err := message.Validate(); err != nil {
+		wsLog.Warn("Dropping invalid file message", "error", err, "nodeId", session.NodeID())
+		return nil
+	}
+
+	err := transfer.Handle(session, &message)
+	if errors.Is(err, transfer.ErrUnknownTransfer) {
+		wsLog.Warn("Dropping message of unknown or finished transfer", "transferId", message.TransferID, "type", message.Type, "nodeId", session.NodeID())
+		return nil
+	}
+	return err
+}
+
+func handleNodeTunnel(session *connections.Session, body []byte) error {
+	var message models.TunnelMessage
+	if err := session.Codec().Unmarshal(body, &message); err != nil {
+		wsLog.Error("Failed to unmarshal tunnel message", "error", err)
+		return err
+	}
+
+	if err := message.Validate(); err != nil {
+		wsLog.Warn("Dropping invalid tunnel message", "error", err, "nodeId", session.NodeID())
+		return nil
+	}
+
+	err := tunnel.Handle(session, &message)
+	if errors.Is(err, tunnel.ErrUnknownTunnel) {
+		wsLog.Warn("Dropping message of unknown or closed tunnel", "tunnelId", message.TunnelID, "type", message.Type, "nodeId", session.NodeID())
+		return nil
+	}
+	return err
+}
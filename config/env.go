@@ -0,0 +1,58 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+func String(name string, defaultValue string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func Int(name string, defaultValue int) int {
+	str := os.Getenv(name)
+	if str == "" {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil {
+		log.Warn("Bad integer value in environment, using default", "envVariable", name, "value", str, "default", defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
+func Duration(name string, defaultValue time.Duration) time.Duration {
+	str := os.Getenv(name)
+	if str == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(str)
+	if err != nil {
+		log.Warn("Bad duration value in environment, using default", "envVariable", name, "value", str, "default", defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
+func Bool(name string, defaultValue bool) bool {
+	str := strings.ToLower(os.Getenv(name))
+	switch str {
+	case "":
+		return defaultValue
+	case "1", "yes", "true":
+		return true
+	case "0", "no", "false":
+		return false
+	}
+	log.Warn("Bad boolean value in environment, using default", "envVariable", name, "value", str, "default", defaultValue)
+	return defaultValue
+}
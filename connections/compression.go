@@ -0,0 +1,171 @@
+package connections
+
+import (
+	"compress/flate"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/websocket"
+	"github.com/zarinit-routers/cloud-connector/config"
+)
+
+const (
+	ENV_COMPRESSION           = "NODE_COMPRESSION"
+	ENV_COMPRESSION_LEVEL     = "NODE_COMPRESSION_LEVEL"
+	ENV_COMPRESSION_THRESHOLD = "NODE_COMPRESSION_THRESHOLD"
+	ENV_BUFFER_SIZE           = "NODE_BUFFER_SIZE"
+)
+
+func getCompressionEnabled() bool {
+	return config.Bool(ENV_COMPRESSION, true)
+}
+
+func getCompressionLevel() int {
+	level := config.Int(ENV_COMPRESSION_LEVEL, flate.BestSpeed)
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		log.Warn("Bad compression level, using default", "envVariable", ENV_COMPRESSION_LEVEL, "level", level)
+		return flate.BestSpeed
+	}
+	return level
+}
+
+// getCompressionThreshold returns the size of the smallest message worth
+// compressing, smaller ones are sent as they are.
+func getCompressionThreshold() int {
+	return config.Int(ENV_COMPRESSION_THRESHOLD, 512)
+}
+
+func newUpgrader() websocket.Upgrader {
+	size := config.Int(ENV_BUFFER_SIZE, 4096)
+	return websocket.Upgrader{
+		ReadBufferSize:    size,
+		WriteBufferSize:   size,
+		EnableCompression: getCompressionEnabled(),
+	}
+}
+
+// compressionNegotiated reports whether permessage-deflate is used by the
+// upgraded connection, it is enabled only when the node offers it.
+func compressionNegotiated(r *http.Request) bool {
+	if !upgrader.EnableCompression {
+		return false
+	}
+	for _, extension := range r.Header.Values("Sec-Websocket-Extensions") {
+		if strings.Contains(extension, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// SessionStats compares message payload sizes with bytes actually sent over
+// the network. Wire bytes include websocket framing and control frames.
+type SessionStats struct {
+	Compressed      bool   `json:"compressed"`
+	MessagesIn      uint64 `json:"messagesIn"`
+	MessagesOut     uint64 `json:"messagesOut"`
+	PayloadBytesIn  uint64 `json:"payloadBytesIn"`
+	PayloadBytesOut uint64 `json:"payloadBytesOut"`
+	WireBytesIn     uint64 `json:"wireBytesIn"`
+	WireBytesOut    uint64 `json:"wireBytesOut"`
+}
+
+type sessionCounters struct {
+	messagesIn      atomic.Uint64
+	messagesOut     atomic.Uint64
+	payloadBytesIn  atomic.Uint64
+	payloadBytesOut atomic.Uint64
+}
+
+func (s *Session) countIn(size int) {
+	s.counters.messagesIn.Add(1)
+	s.counters.payloadBytesIn.Add(uint64(size))
+}
+
+func (s *Session) countOut(size int) {
+	s.counters.messagesOut.Add(1)
+	s.counters.payloadBytesOut.Add(uint64(size))
+}
+
+func (s *Session) Stats() SessionStats {
+	stats := SessionStats{
+		Compressed:      s.compressed,
+		MessagesIn:      s.counters.messagesIn.Load(),
+		MessagesOut:     s.counters.messagesOut.Load(),
+		PayloadBytesIn:  s.counters.payloadBytesIn.Load(),
+		PayloadBytesOut: s.counters.payloadBytesOut.Load(),
+	}
+	if s.wire != nil {
+		stats.WireBytesIn = s.wire.read.Load()
+		stats.WireBytesOut = s.wire.written.Load()
+	}
+	return stats
+}
+
+// setupCompression applies the compression settings to the upgraded
+// connection.
+func (s *Session) setupCompression(r *http.Request) {
+	s.compressed = compressionNegotiated(r)
+	s.compressionThreshold = getCompressionThreshold()
+	s.wire = countingConnFrom(r.Context())
+	if s.compressed {
+		if err := s.conn.SetCompressionLevel(getCompressionLevel()); err != nil {
+			log.Warn("Failed to set compression level", "error", err, "nodeId", s.NodeID())
+		}
+	}
+}
+
+func (s *Session) enableWriteCompression(size int) {
+	if s.compressed {
+		s.conn.EnableWriteCompression(size >= s.compressionThreshold)
+	}
+}
+
+// countingConn counts bytes passing through the network connection.
+type countingConn struct {
+	net.Conn
+	read    atomic.Uint64
+	written atomic.Uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(uint64(n))
+	return n, err
+}
+
+type countingListener struct {
+	net.Listener
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn}, nil
+}
+
+type countingConnKey struct{}
+
+func withCountingConn(ctx context.Context, conn net.Conn) context.Context {
+	if counting, ok := conn.(*countingConn); ok {
+		return context.WithValue(ctx, countingConnKey{}, counting)
+	}
+	return ctx
+}
+
+func countingConnFrom(ctx context.Context) *countingConn {
+	conn, _ := ctx.Value(countingConnKey{}).(*countingConn)
+	return conn
+}
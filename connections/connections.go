@@ -2,9 +2,9 @@ package connections
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 
@@ -14,6 +14,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/zarinit-routers/cloud-connector/models"
 	"github.com/zarinit-routers/cloud-connector/storage/repository"
+	"github.com/zarinit-routers/cloud-connector/tracker"
 )
 
 const (
@@ -23,19 +24,21 @@ const (
 )
 
 var (
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-	}
-	connections = map[models.UUID]*websocket.Conn{}
+	ErrNotConnected       = errors.New("not connected")
+	ErrUnsupportedCommand = errors.New("not supported by node")
+)
+
+var (
+	upgrader = newUpgrader()
+	registry = NewRegistry()
 
 	ctx = context.Background()
 )
 
-func AppendConnection(node *AuthData, conn *websocket.Conn) {
+func AppendConnection(session *Session) {
+	node := session.Auth
 
 	if existingNode, _ := repository.GetNode(node.NodeID); existingNode != nil {
-		log.Warn("Connection with that node already exists, closing it", "nodeId", node.NodeID)
 		if _, err := repository.ReconnectNode(node.NodeID, existingNode.OrganizationID); err != nil {
 			log.Error("Failed to reconnect node", "error", err)
 		}
@@ -43,15 +46,34 @@ func AppendConnection(node *AuthData, conn *websocket.Conn) {
 		repository.NewNode(node.NodeID, node.OrganizationID, GenNodeName())
 	}
 
-	connections[node.NodeID] = conn
+	if old := registry.Replace(session); old != nil {
+		log.Warn("Connection with that node already exists, closing it", "nodeId", node.NodeID, "address", old.RemoteAddr)
+		old.supersede()
+	}
+	go session.writeLoop()
 }
 
-func closeConn(nodeID models.UUID, conn *websocket.Conn) {
-	addr := fmt.Sprintf("%s %s", conn.RemoteAddr().Network(), conn.RemoteAddr().String())
+func closeConn(session *Session) {
+	session.close()
+
+	// Requests written to this session can't be answered anymore, even when
+	// the node is already connected again
+	if failed := tracker.FailSession(session.ID, tracker.RequestErrorNodeDisconnected); failed > 0 {
+		log.Warn("Failed pending requests of closed connection", "nodeId", session.NodeID(), "requests", failed)
+	}
+
+	if !registry.Remove(session) {
+		log.Warn("Connection closed", "address", session.RemoteAddr, "nodeId", session.NodeID(), "superseded", true)
+		return
+	}
+
+	repository.UpdateLastConnection(session.NodeID())
 
-	repository.UpdateLastConnection(nodeID)
+	for _, handler := range disconnectHandlers {
+		handler(session)
+	}
 
-	log.Warn("Connection closed", "address", addr)
+	log.Warn("Connection closed", "address", session.RemoteAddr, "nodeId", session.NodeID(), "stats", session.Stats())
 }
 
 func Serve() {
@@ -70,22 +92,42 @@ func Serve() {
 			return
 		}
 
-		AppendConnection(auth, conn)
+		session := newSession(auth, conn)
+		session.setupCompression(r)
+		AppendConnection(session)
+
+		go serveConnection(session)
 
-		go serveConnection(auth.NodeID, conn)
+		for _, handler := range connectHandlers {
+			go func() {
+				select {
+				case <-session.Ready():
+					handler(session)
+				case <-session.closed:
+				}
+			}()
+		}
 
 		log.Info("Connection established", "nodeId", auth.NodeID, "groupId", auth.OrganizationID)
 	})
 
 	log.Info("Starting connections server", "address", getAddress())
-	http.ListenAndServe(getAddress(), srv)
+	listener, err := net.Listen("tcp", getAddress())
+	if err != nil {
+		log.Fatal("Failed to listen", "error", err, "address", getAddress())
+	}
+	server := &http.Server{
+		Handler:     srv,
+		ConnContext: withCountingConn,
+	}
+	server.Serve(&countingListener{Listener: listener})
 }
 
 type AuthData struct {
 	NodeID         models.UUID
 	OrganizationID models.UUID
 }
-type MessageHandlerFunc func(message []byte) error
+type MessageHandlerFunc func(session *Session, message []byte) error
 
 var handlers = []MessageHandlerFunc{}
 
@@ -93,31 +135,66 @@ func AddHandler(handler MessageHandlerFunc) {
 	handlers = append(handlers, handler)
 }
 
-func serveConnection(nodeId models.UUID, conn *websocket.Conn) {
+// SessionHandlerFunc is called when a node connects and when the current
+// session of a node is closed, superseded sessions don't trigger it. Connect
+// handlers run after the handshake.
+type SessionHandlerFunc func(session *Session)
+
+var (
+	connectHandlers    = []SessionHandlerFunc{}
+	disconnectHandlers = []SessionHandlerFunc{}
+)
+
+func AddConnectHandler(handler SessionHandlerFunc) {
+	connectHandlers = append(connectHandlers, handler)
+}
+
+func AddDisconnectHandler(handler SessionHandlerFunc) {
+	disconnectHandlers = append(disconnectHandlers, handler)
+}
+
+func serveConnection(session *Session) {
+	// Registered first so it runs even if closeConn panics, supersede waits
+	// for it
+	defer close(session.readerDone)
 	defer func() {
-		if recover() != nil {
-			log.Error("Connection closed with panic", "nodeId", nodeId, "panic", recover())
+		if r := recover(); r != nil {
+			log.Error("Connection closed with panic", "nodeId", session.NodeID(), "panic", r)
+			session.setCloseReason(fmt.Sprintf("panic: %v", r))
 		}
-		closeConn(nodeId, conn)
+		closeConn(session)
 	}()
+	session.setupHeartbeat()
+	session.startHandshake()
+	first := true
 	for {
-		messageType, message, err := conn.ReadMessage()
+		messageType, message, err := session.conn.ReadMessage()
 		if err != nil {
-			log.Error("Failed to read message", "error", err)
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
-				log.Error("Unexpected closing connection", "error", err)
-				return
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Error("Unexpected closing connection", "nodeId", session.NodeID(), "error", err)
+			} else {
+				log.Warn("Connection read finished", "nodeId", session.NodeID(), "error", err)
 			}
-			continue
+			session.setCloseReason(readErrorReason(err))
+			return
 		}
+		session.extendReadDeadline()
+		session.countIn(len(message))
 
 		if messageType == websocket.CloseMessage {
 			return
 		}
 
+		if first {
+			first = false
+			if session.handshake(message) {
+				continue
+			}
+		}
+
 		for _, handler := range handlers {
 			go func() {
-				if err := handler(message); err != nil {
+				if err := handler(session, message); err != nil {
 					log.Error("Failed to handle message", "error", err)
 				}
 			}()
@@ -125,6 +202,18 @@ func serveConnection(nodeId models.UUID, conn *websocket.Conn) {
 	}
 }
 
+func readErrorReason(err error) string {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return fmt.Sprintf("closed by node: %d %s", closeErr.Code, closeErr.Text)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "heartbeat timeout"
+	}
+	return fmt.Sprintf("read failed: %s", err)
+}
+
 func checkAuth(r *http.Request) (*AuthData, error) {
 
 	tokenStr := r.Header.Get(AuthorizationHeader)
@@ -162,22 +251,32 @@ func getAddress() string {
 	return ":8071"
 }
 
+// SendRequest returns once the request is written to the node connection.
 func SendRequest(nodeId string, r *models.ToNodeRequest) error {
 	id, err := uuid.Parse(nodeId)
 	if err != nil {
 		return fmt.Errorf("bad node id %q: %s", nodeId, err)
 	}
-	conn, ok := connections[id]
+	session, ok := registry.Get(id)
 	if !ok {
-		return fmt.Errorf("node with id %q not connected", nodeId)
+		return fmt.Errorf("node with id %q %w", nodeId, ErrNotConnected)
 	}
+	return session.SendRequest(r)
+}
 
-	message, err := json.Marshal(r)
-	if err != nil {
-		return err
+// SendRequest waits for the handshake and writes the request to this
+// session, it returns once the request is written.
+func (s *Session) SendRequest(r *models.ToNodeRequest) error {
+	select {
+	case <-s.Ready():
+	case <-s.closed:
+		return ErrSessionClosed
+	}
+	if !s.Supports(r.Command) {
+		return fmt.Errorf("command %q %w", r.Command, ErrUnsupportedCommand)
 	}
 
-	return conn.WriteMessage(websocket.TextMessage, message)
+	return s.WriteMessage(r)
 }
 
 func getJwtKey() jwt.Keyfunc {
@@ -190,7 +289,11 @@ func getJwtKey() jwt.Keyfunc {
 	}
 }
 
+func GetSession(nodeId models.UUID) (*Session, bool) {
+	return registry.Get(nodeId)
+}
+
 func IsConnected(nodeId models.UUID) bool {
-	_, ok := connections[nodeId]
+	_, ok := registry.Get(nodeId)
 	return ok
 }
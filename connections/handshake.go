@@ -0,0 +1,139 @@
+package connections
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/websocket"
+	"github.com/zarinit-routers/cloud-connector/config"
+	"github.com/zarinit-routers/cloud-connector/models"
+	"github.com/zarinit-routers/cloud-connector/storage/repository"
+)
+
+const (
+	ENV_HANDSHAKE_TIMEOUT = "NODE_HANDSHAKE_TIMEOUT"
+)
+
+func getHandshakeTimeout() time.Duration {
+	return config.Duration(ENV_HANDSHAKE_TIMEOUT, 5*time.Second)
+}
+
+// Hello returns the handshake of the node, it is nil for nodes that didn't
+// send one.
+func (s *Session) Hello() *models.NodeHello {
+	s.infoMu.RLock()
+	defer s.infoMu.RUnlock()
+	return s.hello
+}
+
+// Codec returns the encoding negotiated in the handshake.
+func (s *Session) Codec() models.Codec {
+	s.infoMu.RLock()
+	defer s.infoMu.RUnlock()
+	return s.codec
+}
+
+// Supports reports whether the command may be sent to the node. Nodes
+// without a handshake are assumed to support every command.
+func (s *Session) Supports(command string) bool {
+	hello := s.Hello()
+	return hello == nil || hello.Supports(command)
+}
+
+// Ready is closed once the handshake is done, or once it is clear that the
+// node doesn't send one.
+func (s *Session) Ready() <-chan struct{} {
+	return s.ready
+}
+
+func (s *Session) markReady() {
+	s.readyOnce.Do(func() {
+		close(s.ready)
+	})
+}
+
+// startHandshake waits for the hello of the node for the handshake timeout,
+// after that the node is treated as a legacy one.
+func (s *Session) startHandshake() {
+	timer := time.AfterFunc(getHandshakeTimeout(), func() {
+		select {
+		case <-s.ready:
+		case <-s.closed:
+		default:
+			log.Warn("Node didn't send handshake, treating it as legacy node", "nodeId", s.NodeID())
+			s.markReady()
+		}
+	})
+	go func() {
+		select {
+		case <-s.ready:
+		case <-s.closed:
+		}
+		timer.Stop()
+	}()
+}
+
+// handshake handles the first message of the node. It returns false if the
+// message isn't a hello and has to be handled as a regular message. A bad
+// hello closes the connection.
+func (s *Session) handshake(message []byte) bool {
+	// The handshake is always sent in JSON
+	messageType, err := models.ParseMessageType(models.JSONCodec, message)
+	if err != nil || messageType != models.MessageTypeHello {
+		log.Warn("First message of node is not a handshake, treating it as legacy node", "nodeId", s.NodeID())
+		s.markReady()
+		return false
+	}
+
+	var hello models.NodeHello
+	if err := json.Unmarshal(message, &hello); err != nil {
+		log.Error("Failed to unmarshal handshake", "error", err, "nodeId", s.NodeID())
+		s.reject(fmt.Sprintf("bad handshake: %s", err))
+		return true
+	}
+	if err := hello.Validate(); err != nil {
+		log.Error("Bad handshake", "error", err, "nodeId", s.NodeID())
+		s.reject(fmt.Sprintf("bad handshake: %s", err))
+		return true
+	}
+
+	defer s.markReady()
+
+	welcome, err := json.Marshal(hello.Welcome())
+	if err != nil {
+		log.Error("Failed to marshal welcome", "error", err)
+		return true
+	}
+	if err := s.Send(websocket.TextMessage, welcome); err != nil {
+		log.Error("Failed to send welcome", "error", err, "nodeId", s.NodeID())
+		return true
+	}
+
+	// Switch the codec only after the welcome is queued, so the welcome is
+	// still sent in JSON
+	s.infoMu.Lock()
+	s.hello = &hello
+	s.codec = models.NegotiateCodec(hello.Encodings)
+	s.infoMu.Unlock()
+
+	if err := repository.UpdateNodeHandshake(s.NodeID(), hello.ProtocolVersion, hello.FirmwareVersion, hello.Model, hello.Commands); err != nil {
+		log.Error("Failed to store handshake", "error", err, "nodeId", s.NodeID())
+	}
+
+	log.Info("Handshake done", "nodeId", s.NodeID(), "protocolVersion", hello.Welcome().ProtocolVersion, "encoding", s.Codec().Name(), "firmwareVersion", hello.FirmwareVersion, "model", hello.Model, "commands", len(hello.Commands))
+	return true
+}
+
+// reject closes the connection with a protocol error, the session never
+// becomes ready.
+func (s *Session) reject(reason string) {
+	s.setCloseReason(reason)
+	// Close frames are short, the full reason is kept in the session
+	message := websocket.FormatCloseMessage(websocket.CloseProtocolError, "bad handshake")
+	if err := s.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(getWriteTimeout())); err != nil {
+		log.Warn("Failed to send close frame", "nodeId", s.NodeID(), "error", err)
+	}
+	s.close()
+}
@@ -0,0 +1,48 @@
+package connections
+
+import (
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/websocket"
+	"github.com/zarinit-routers/cloud-connector/config"
+)
+
+const (
+	ENV_PING_INTERVAL = "NODE_PING_INTERVAL"
+	ENV_PONG_TIMEOUT  = "NODE_PONG_TIMEOUT"
+)
+
+func getPingInterval() time.Duration {
+	return config.Duration(ENV_PING_INTERVAL, 10*time.Second)
+}
+
+// getPongTimeout returns how long the connection may stay silent before it
+// is considered dead, it is never shorter than the ping interval.
+func getPongTimeout() time.Duration {
+	interval := getPingInterval()
+	timeout := config.Duration(ENV_PONG_TIMEOUT, 25*time.Second)
+	if timeout <= interval {
+		log.Warn("Pong timeout must be longer than ping interval, adjusting it", "envVariable", ENV_PONG_TIMEOUT, "pingInterval", interval)
+		timeout = interval * 2
+	}
+	return timeout
+}
+
+// setupHeartbeat arms the read deadline and extends it on every pong, a
+// half-open connection fails the next read when the deadline passes.
+func (s *Session) setupHeartbeat() {
+	s.readTimeout = getPongTimeout()
+	s.extendReadDeadline()
+	s.conn.SetPongHandler(func(string) error {
+		return s.extendReadDeadline()
+	})
+}
+
+func (s *Session) extendReadDeadline() error {
+	return s.conn.SetReadDeadline(time.Now().Add(s.readTimeout))
+}
+
+func (s *Session) ping() error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(getWriteTimeout()))
+}
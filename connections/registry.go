@@ -0,0 +1,54 @@
+package connections
+
+import (
+	"sync"
+
+	"github.com/zarinit-routers/cloud-connector/models"
+)
+
+// Registry holds the current session of every connected node.
+type Registry struct {
+	mu       sync.RWMutex
+	sessions map[models.UUID]*Session
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		sessions: map[models.UUID]*Session{},
+	}
+}
+
+func (r *Registry) Get(nodeID models.UUID) (*Session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.sessions[nodeID]
+	return s, ok
+}
+
+// Replace stores the session as the current one for its node and returns
+// the previous session, if there was any.
+func (r *Registry) Replace(s *Session) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.sessions[s.NodeID()]
+	r.sessions[s.NodeID()] = s
+	return old
+}
+
+// Remove deletes the session only if it is still the current one for its
+// node, so a stale session can't remove its successor.
+func (r *Registry) Remove(s *Session) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current, ok := r.sessions[s.NodeID()]; !ok || current != s {
+		return false
+	}
+	delete(r.sessions, s.NodeID())
+	return true
+}
+
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sessions)
+}
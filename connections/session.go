@@ -0,0 +1,258 @@
+package connections
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/zarinit-routers/cloud-connector/config"
+	"github.com/zarinit-routers/cloud-connector/models"
+)
+
+const (
+	ENV_OUTBOUND_QUEUE_SIZE = "NODE_OUTBOUND_QUEUE_SIZE"
+	ENV_WRITE_TIMEOUT       = "NODE_WRITE_TIMEOUT"
+)
+
+// CloseSuperseded is sent to the old connection of a node when the node
+// connects again.
+const CloseSuperseded = 4001
+
+var (
+	ErrOutboundFull  = errors.New("node busy: outbound queue full")
+	ErrSessionClosed = errors.New("node session closed")
+)
+
+func getOutboundQueueSize() int {
+	size := config.Int(ENV_OUTBOUND_QUEUE_SIZE, 64)
+	if size <= 0 {
+		log.Warn("Outbound queue size must be positive, using default", "envVariable", ENV_OUTBOUND_QUEUE_SIZE)
+		return 64
+	}
+	return size
+}
+
+func getWriteTimeout() time.Duration {
+	return config.Duration(ENV_WRITE_TIMEOUT, 10*time.Second)
+}
+
+type outboundMessage struct {
+	messageType int
+	data        []byte
+	// written receives the result of the write, if it is not nil
+	written chan error
+}
+
+// Session is a single live websocket connection of a node. Every write to
+// the connection goes through the outbound queue and the session writer
+// goroutine, gorilla connections support only one concurrent writer.
+type Session struct {
+	// ID tells apart sessions of the same node
+	ID          string
+	Auth        *AuthData
+	ConnectedAt time.Time
+	RemoteAddr  string
+
+	conn        *websocket.Conn
+	readTimeout time.Duration
+	outbound    chan outboundMessage
+	closed      chan struct{}
+	closeOnce   sync.Once
+	readerDone  chan struct{}
+
+	reasonMu    sync.Mutex
+	closeReason string
+	closedAt    time.Time
+
+	compressed           bool
+	compressionThreshold int
+	wire                 *countingConn
+	counters             sessionCounters
+
+	infoMu    sync.RWMutex
+	hello     *models.NodeHello
+	codec     models.Codec
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+func newSession(auth *AuthData, conn *websocket.Conn) *Session {
+	return &Session{
+		ID:          uuid.NewString(),
+		Auth:        auth,
+		ConnectedAt: time.Now(),
+		RemoteAddr:  fmt.Sprintf("%s %s", conn.RemoteAddr().Network(), conn.RemoteAddr().String()),
+		conn:        conn,
+		outbound:    make(chan outboundMessage, getOutboundQueueSize()),
+		closed:      make(chan struct{}),
+		readerDone:  make(chan struct{}),
+		ready:       make(chan struct{}),
+		codec:       models.JSONCodec,
+	}
+}
+
+func (s *Session) NodeID() models.UUID {
+	return s.Auth.NodeID
+}
+
+func (s *Session) OrganizationID() models.UUID {
+	return s.Auth.OrganizationID
+}
+
+// Send queues a frame for the writer goroutine without blocking, it fails
+// with ErrOutboundFull if the node doesn't keep up with its queue.
+func (s *Session) Send(messageType int, data []byte) error {
+	return s.enqueue(outboundMessage{messageType: messageType, data: data})
+}
+
+// Write queues a frame like Send does and waits until the writer goroutine
+// has actually written it to the connection.
+func (s *Session) Write(messageType int, data []byte) error {
+	written := make(chan error, 1)
+	if err := s.enqueue(outboundMessage{messageType: messageType, data: data, written: written}); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-written:
+		return err
+	case <-s.closed:
+		return ErrSessionClosed
+	}
+}
+
+func (s *Session) enqueue(m outboundMessage) error {
+	select {
+	case <-s.closed:
+		return ErrSessionClosed
+	default:
+	}
+
+	select {
+	case s.outbound <- m:
+		return nil
+	case <-s.closed:
+		return ErrSessionClosed
+	default:
+		return ErrOutboundFull
+	}
+}
+
+func (s *Session) writeLoop() {
+	timeout := getWriteTimeout()
+	ticker := time.NewTicker(getPingInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			if err := s.ping(); err != nil {
+				log.Error("Failed to ping node, closing connection", "nodeId", s.NodeID(), "error", err)
+				s.setCloseReason(fmt.Sprintf("ping failed: %s", err))
+				s.conn.Close()
+				return
+			}
+		case m := <-s.outbound:
+			s.conn.SetWriteDeadline(time.Now().Add(timeout))
+			s.enableWriteCompression(len(m.data))
+			err := s.conn.WriteMessage(m.messageType, m.data)
+			s.countOut(len(m.data))
+			if m.written != nil {
+				m.written <- err
+			}
+			if err != nil {
+				log.Error("Failed to write message, closing connection", "nodeId", s.NodeID(), "error", err)
+				s.setCloseReason(fmt.Sprintf("write failed: %s", err))
+				s.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// close stops the writer goroutine and closes the underlying connection,
+// frames still waiting in the outbound queue are dropped.
+func (s *Session) close() {
+	s.closeOnce.Do(func() {
+		s.reasonMu.Lock()
+		s.closedAt = time.Now()
+		s.reasonMu.Unlock()
+		close(s.closed)
+		s.conn.Close()
+	})
+}
+
+// Done is closed when the session is closed, superseded sessions included.
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+// setCloseReason records why the session is closing, only the first reason
+// is kept.
+func (s *Session) setCloseReason(reason string) {
+	s.reasonMu.Lock()
+	defer s.reasonMu.Unlock()
+	if s.closeReason == "" {
+		s.closeReason = reason
+	}
+}
+
+func (s *Session) CloseReason() string {
+	s.reasonMu.Lock()
+	defer s.reasonMu.Unlock()
+	return s.closeReason
+}
+
+// ClosedAt returns zero time while the session is open.
+func (s *Session) ClosedAt() time.Time {
+	s.reasonMu.Lock()
+	defer s.reasonMu.Unlock()
+	return s.closedAt
+}
+
+// supersede closes a session replaced by a newer connection of the same
+// node. It sends a close frame, gives the node a write timeout to answer it
+// and waits until the session reader has finished, so the old reader can't
+// interfere with the new session. A reader still busy a write timeout after
+// the connection was closed is left behind, the new session goes on.
+func (s *Session) supersede() {
+	s.setCloseReason("superseded")
+	timeout := getWriteTimeout()
+	message := websocket.FormatCloseMessage(CloseSuperseded, "superseded")
+	if err := s.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(timeout)); err != nil {
+		log.Warn("Failed to send close frame to superseded connection", "nodeId", s.NodeID(), "error", err)
+	}
+
+	select {
+	case <-s.readerDone:
+		return
+	case <-time.After(timeout):
+		log.Warn("Superseded connection didn't close in time, closing it forcibly", "nodeId", s.NodeID())
+	}
+	s.close()
+	select {
+	case <-s.readerDone:
+	case <-time.After(timeout):
+		log.Warn("Reader of superseded connection is still busy, not waiting for it", "nodeId", s.NodeID())
+	}
+}
+
+// WriteMessage encodes the message with the session codec and writes it, it
+// returns once the message is written to the connection.
+func (s *Session) WriteMessage(v any) error {
+	c := s.Codec()
+	data, err := c.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %s", err)
+	}
+	messageType := websocket.TextMessage
+	if c.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+	return s.Write(messageType, data)
+}
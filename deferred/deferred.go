@@ -0,0 +1,129 @@
+package deferred
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/zarinit-routers/cloud-connector/config"
+	"github.com/zarinit-routers/cloud-connector/connections"
+	"github.com/zarinit-routers/cloud-connector/models"
+	"github.com/zarinit-routers/cloud-connector/queue"
+	"github.com/zarinit-routers/cloud-connector/storage/repository"
+	"github.com/zarinit-routers/cloud-connector/tracker"
+)
+
+const (
+	ENV_DEFERRED_REQUEST_TTL = "DEFERRED_REQUEST_TTL"
+	ENV_EXPIRY_INTERVAL      = "DEFERRED_EXPIRY_INTERVAL"
+
+	RequestErrorExpired = "expired before node connected"
+)
+
+var (
+	dlog = log.WithPrefix("Deferred")
+
+	// flushMu keeps concurrent flushes from sending the same request twice
+	flushMu sync.Mutex
+)
+
+func getDefaultTTL() time.Duration {
+	return config.Duration(ENV_DEFERRED_REQUEST_TTL, 24*time.Hour)
+}
+
+func getExpiryInterval() time.Duration {
+	return config.Duration(ENV_EXPIRY_INTERVAL, time.Minute)
+}
+
+// DispatchFunc tracks a request and sends it to the connected node.
+type DispatchFunc func(route queue.Route, nodeId models.UUID, r *models.FromCloudRequest) error
+
+// ReplyFactory returns the function replying to the cloud for a request.
+type ReplyFactory func(route queue.Route) tracker.ReplyFunc
+
+// Store persists a request to an offline node until the node connects or
+// the request expires.
+func Store(route queue.Route, nodeId models.UUID, r *models.FromCloudRequest) error {
+	ttl := r.ExpiresIn()
+	if ttl == 0 {
+		ttl = getDefaultTTL()
+	}
+	_, err := repository.NewDeferredRequest(route.RequestID, route.ReplyTo, nodeId, r.Command, r.Args, r.TimeoutSeconds, time.Now().Add(ttl))
+	if err != nil {
+		return err
+	}
+	dlog.Info("Request deferred until node connects", "requestId", route.RequestID, "nodeId", nodeId, "ttl", ttl)
+	return nil
+}
+
+// Flush sends stored requests to the newly connected node in order. It stops
+// on the first request the node can't take right now, the rest are kept for
+// the next connection.
+func Flush(session *connections.Session, dispatch DispatchFunc, reply ReplyFactory) {
+	flushMu.Lock()
+	defer flushMu.Unlock()
+
+	requests, err := repository.GetDeferredRequests(session.NodeID())
+	if err != nil {
+		dlog.Error("Failed get deferred requests", "error", err, "nodeId", session.NodeID())
+		return
+	}
+
+	for _, stored := range requests {
+		request := &models.FromCloudRequest{
+			NodeID:         stored.NodeID.String(),
+			Command:        stored.Command,
+			Args:           stored.Args.Val,
+			TimeoutSeconds: stored.TimeoutSeconds,
+		}
+		route := routeOf(&stored)
+		err := dispatch(route, stored.NodeID, request)
+		if errors.Is(err, connections.ErrNotConnected) || errors.Is(err, connections.ErrOutboundFull) || errors.Is(err, connections.ErrSessionClosed) {
+			dlog.Warn("Node can't take deferred requests now, keeping the rest", "nodeId", stored.NodeID, "error", err)
+			return
+		}
+		if errors.Is(err, tracker.ErrDuplicateRequestID) {
+			dlog.Warn("Deferred request is already pending", "requestId", stored.RequestID, "nodeId", stored.NodeID)
+		} else if err != nil {
+			dlog.Error("Failed to send deferred request", "error", err, "requestId", stored.RequestID)
+			reply(route)(&models.ToCloudResponse{
+				RequestError: err.Error(),
+			})
+		} else {
+			dlog.Info("Deferred request sent", "requestId", stored.RequestID, "nodeId", stored.NodeID)
+		}
+		if err := repository.RemoveDeferredRequest(stored.RequestID); err != nil {
+			dlog.Error("Failed remove deferred request", "error", err, "requestId", stored.RequestID)
+		}
+	}
+}
+
+// ServeExpiry periodically removes expired requests and replies an error
+// for each of them.
+func ServeExpiry(reply ReplyFactory) {
+	ticker := time.NewTicker(getExpiryInterval())
+	defer ticker.Stop()
+	for range ticker.C {
+		expired, err := repository.RemoveExpiredDeferredRequests()
+		if err != nil {
+			dlog.Error("Failed remove expired deferred requests", "error", err)
+			continue
+		}
+		for _, stored := range expired {
+			dlog.Warn("Deferred request expired", "requestId", stored.RequestID, "nodeId", stored.NodeID)
+			reply(routeOf(&stored))(&models.ToCloudResponse{
+				RequestError: RequestErrorExpired,
+			})
+		}
+	}
+}
+
+func routeOf(stored *repository.DeferredRequest) queue.Route {
+	return queue.Route{
+		RequestID: stored.RequestID,
+		ReplyTo:   stored.ReplyTo,
+		NodeID:    stored.NodeID,
+		Command:   stored.Command,
+	}
+}
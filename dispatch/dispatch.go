@@ -0,0 +1,68 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zarinit-routers/cloud-connector/connections"
+	"github.com/zarinit-routers/cloud-connector/models"
+	"github.com/zarinit-routers/cloud-connector/tracker"
+)
+
+// Send tracks a request to the node and writes it to the current node
+// session. The reply is called with the response, or with a timeout or
+// disconnect error, unless Send itself fails.
+func Send(requestID string, nodeID models.UUID, command string, args models.JsonMap, timeout time.Duration, reply tracker.ReplyFunc) error {
+	return SendStream(requestID, nodeID, command, args, timeout, "", nil, reply)
+}
+
+// SendStream is Send for a request whose chunked response is handled in the
+// stream mode, part gets the chunks in the forward mode.
+func SendStream(requestID string, nodeID models.UUID, command string, args models.JsonMap, timeout time.Duration, mode string, part tracker.PartFunc, reply tracker.ReplyFunc) error {
+	session, ok := connections.GetSession(nodeID)
+	if !ok {
+		return fmt.Errorf("node with id %q %w", nodeID, connections.ErrNotConnected)
+	}
+
+	timeout = tracker.Timeout(command, timeout)
+	if err := tracker.TrackSession(requestID, nodeID, session.ID, command, timeout, reply); err != nil {
+		return fmt.Errorf("failed to track request: %w", err)
+	}
+	if mode != "" {
+		tracker.SetStream(requestID, mode, part)
+	}
+
+	request := &models.ToNodeRequest{
+		RequestID: requestID,
+		Command:   command,
+		Args:      args,
+	}
+	if err := session.SendRequest(request); err != nil {
+		tracker.Cancel(requestID)
+		return err
+	}
+	return nil
+}
+
+// Call sends a request to the node and waits for its response. The request
+// is forgotten when the context is done first.
+func Call(ctx context.Context, nodeID models.UUID, command string, args models.JsonMap, timeout time.Duration) (*models.ToCloudResponse, error) {
+	requestID := uuid.NewString()
+	replies := make(chan *models.ToCloudResponse, 1)
+	err := Send(requestID, nodeID, command, args, timeout, func(response *models.ToCloudResponse) {
+		replies <- response
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case response := <-replies:
+		return response, nil
+	case <-ctx.Done():
+		tracker.Cancel(requestID)
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,165 @@
+package fanout
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/zarinit-routers/cloud-connector/config"
+	"github.com/zarinit-routers/cloud-connector/connections"
+	"github.com/zarinit-routers/cloud-connector/dispatch"
+	"github.com/zarinit-routers/cloud-connector/models"
+	"github.com/zarinit-routers/cloud-connector/storage/repository"
+)
+
+const (
+	ENV_FANOUT_CONCURRENCY = "FANOUT_CONCURRENCY"
+)
+
+var (
+	flog = log.WithPrefix("Fanout")
+)
+
+func getConcurrency() int {
+	return max(config.Int(ENV_FANOUT_CONCURRENCY, 32), 1)
+}
+
+// NodeResult is the response of one node.
+type NodeResult struct {
+	NodeID       models.UUID    `json:"nodeId"`
+	RequestError string         `json:"requestError"`
+	CommandError string         `json:"commandError"`
+	Data         models.JsonMap `json:"data"`
+}
+
+func (r *NodeResult) succeeded() bool {
+	return r.RequestError == "" && r.CommandError == ""
+}
+
+// Result aggregates responses of every selected node. Offline nodes are not
+// connected to this connector instance and got nothing.
+type Result struct {
+	Total     int           `json:"total"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Offline   []models.UUID `json:"offline"`
+	Results   []NodeResult  `json:"results"`
+}
+
+// ToCloud packs the result into the data of one response.
+func (r *Result) ToCloud() *models.ToCloudResponse {
+	results := make([]any, 0, len(r.Results))
+	for _, result := range r.Results {
+		results = append(results, models.JsonMap{
+			"nodeId":       result.NodeID.String(),
+			"requestError": result.RequestError,
+			"commandError": result.CommandError,
+			"data":         result.Data,
+		})
+	}
+	offline := make([]any, 0, len(r.Offline))
+	for _, id := range r.Offline {
+		offline = append(offline, id.String())
+	}
+	return &models.ToCloudResponse{
+		Data: models.JsonMap{
+			"total":     r.Total,
+			"succeeded": r.Succeeded,
+			"failed":    r.Failed,
+			"offline":   offline,
+			"results":   results,
+		},
+	}
+}
+
+// Select returns the nodes targeted by the selector.
+func Select(selector *models.Selector) ([]repository.Node, error) {
+	organizationID, err := selector.ParseOrganizationID()
+	if err != nil {
+		return nil, err
+	}
+	return repository.GetNodesBySelector(organizationID, selector.Tag)
+}
+
+// Run sends the command to every connected node and returns once all of
+// them are written, done is called with the aggregated result when every
+// node answered or timed out.
+func Run(nodes []repository.Node, command string, args models.JsonMap, timeout time.Duration, done func(*Result)) {
+	result := &Result{
+		Total:   len(nodes),
+		Offline: []models.UUID{},
+		Results: []NodeResult{},
+	}
+
+	var mu sync.Mutex
+	var answered sync.WaitGroup
+	add := func(nodeResult NodeResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		result.Results = append(result.Results, nodeResult)
+		if nodeResult.succeeded() {
+			result.Succeeded++
+		} else {
+			result.Failed++
+		}
+	}
+
+	var sent sync.WaitGroup
+	limit := make(chan struct{}, getConcurrency())
+	for _, node := range nodes {
+		if !connections.IsConnected(node.ID) {
+			mu.Lock()
+			result.Offline = append(result.Offline, node.ID)
+			mu.Unlock()
+			continue
+		}
+		answered.Add(1)
+		sent.Add(1)
+		limit <- struct{}{}
+		go func() {
+			defer sent.Done()
+			defer func() { <-limit }()
+			err := dispatch.Send(uuid.NewString(), node.ID, command, args, timeout, func(response *models.ToCloudResponse) {
+				add(NodeResult{
+					NodeID:       node.ID,
+					RequestError: response.RequestError,
+					CommandError: response.CommandError,
+					Data:         response.Data,
+				})
+				answered.Done()
+			})
+			if errors.Is(err, connections.ErrNotConnected) {
+				mu.Lock()
+				result.Offline = append(result.Offline, node.ID)
+				mu.Unlock()
+				answered.Done()
+			} else if err != nil {
+				add(NodeResult{
+					NodeID:       node.ID,
+					RequestError: err.Error(),
+				})
+				answered.Done()
+			}
+		}()
+	}
+	sent.Wait()
+	mu.Lock()
+	flog.Info("Command sent to selected nodes", "command", command, "total", result.Total, "offline", len(result.Offline))
+	mu.Unlock()
+
+	go func() {
+		answered.Wait()
+		done(result)
+	}()
+}
+
+// Call runs the command on the nodes and waits for the aggregated result.
+func Call(nodes []repository.Node, command string, args models.JsonMap, timeout time.Duration) *Result {
+	results := make(chan *Result, 1)
+	Run(nodes, command, args, timeout, func(result *Result) {
+		results <- result
+	})
+	return <-results
+}
@@ -0,0 +1,228 @@
+package jobs
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/zarinit-routers/cloud-connector/config"
+	"github.com/zarinit-routers/cloud-connector/connections"
+	"github.com/zarinit-routers/cloud-connector/dispatch"
+	"github.com/zarinit-routers/cloud-connector/models"
+	"github.com/zarinit-routers/cloud-connector/storage/repository"
+	"github.com/zarinit-routers/cloud-connector/tracker"
+)
+
+const (
+	ENV_JOB_TIMEOUT         = "JOB_TIMEOUT"
+	ENV_JOB_QUEUE_TTL       = "JOB_QUEUE_TTL"
+	ENV_JOB_EXPIRY_INTERVAL = "JOB_EXPIRY_INTERVAL"
+	ENV_JOB_FLUSH_INTERVAL  = "JOB_FLUSH_INTERVAL"
+
+	RequestErrorQueueExpired = "expired before node connected"
+)
+
+var (
+	jlog = log.WithPrefix("Jobs")
+
+	// flushMu keeps concurrent flushes from sending the same job twice
+	flushMu sync.Mutex
+)
+
+func getDefaultTimeout() time.Duration {
+	return config.Duration(ENV_JOB_TIMEOUT, time.Hour)
+}
+
+func getQueueTTL() time.Duration {
+	return config.Duration(ENV_JOB_QUEUE_TTL, 24*time.Hour)
+}
+
+func getExpiryInterval() time.Duration {
+	return config.Duration(ENV_JOB_EXPIRY_INTERVAL, time.Minute)
+}
+
+func getFlushInterval() time.Duration {
+	return config.Duration(ENV_JOB_FLUSH_INTERVAL, 10*time.Second)
+}
+
+func timeoutOf(job *repository.Job) time.Duration {
+	if job.TimeoutSeconds > 0 {
+		return time.Duration(job.TimeoutSeconds) * time.Second
+	}
+	return getDefaultTimeout()
+}
+
+// Create stores a job and sends it to the node if it is connected to this
+// instance, otherwise the job is queued until the node connects. Jobs of
+// nodes connected to another instance are sent by its ServeQueued.
+func Create(node *repository.Node, command string, args models.JsonMap, timeoutSeconds int) (*repository.Job, error) {
+	job, err := repository.NewJob(node.ID, node.OrganizationID, command, args, timeoutSeconds)
+	if err != nil {
+		return nil, err
+	}
+	if connections.IsConnected(node.ID) {
+		send(job)
+	}
+	return job, nil
+}
+
+// Flush sends jobs queued for the newly connected node in order.
+func Flush(session *connections.Session) {
+	flushMu.Lock()
+	defer flushMu.Unlock()
+
+	jobs, err := repository.GetQueuedJobs(session.NodeID())
+	if err != nil {
+		jlog.Error("Failed get queued jobs", "error", err, "nodeId", session.NodeID())
+		return
+	}
+	for _, job := range jobs {
+		if time.Since(job.CreatedAt) > getQueueTTL() {
+			finish(job.ID, &models.ToCloudResponse{RequestError: RequestErrorQueueExpired}, []string{repository.JobStateQueued})
+			continue
+		}
+		if !send(&job) {
+			return
+		}
+	}
+}
+
+// ServeQueued sends queued jobs of nodes connected to this instance every
+// flush interval. Jobs are created by any instance, while only the one
+// holding the node session can send them.
+func ServeQueued() {
+	ticker := time.NewTicker(getFlushInterval())
+	defer ticker.Stop()
+	for range ticker.C {
+		flushConnected()
+	}
+}
+
+func flushConnected() {
+	nodeIDs, err := repository.GetQueuedJobNodes()
+	if err != nil {
+		jlog.Error("Failed get nodes with queued jobs", "error", err)
+		return
+	}
+	for _, nodeID := range nodeIDs {
+		if session, ok := connections.GetSession(nodeID); ok {
+			Flush(session)
+		}
+	}
+}
+
+// ServeExpiry times out jobs queued longer than the queue TTL and jobs sent
+// or running past their deadline, at start and every expiry interval. The
+// latter are left by a restart of the connector, the tracker times out the
+// others first.
+func ServeExpiry() {
+	expire()
+	ticker := time.NewTicker(getExpiryInterval())
+	defer ticker.Stop()
+	for range ticker.C {
+		expire()
+	}
+}
+
+func expire() {
+	queued, err := repository.TimeOutQueuedJobs(time.Now().Add(-getQueueTTL()), RequestErrorQueueExpired)
+	if err != nil {
+		jlog.Error("Failed to time out queued jobs", "error", err)
+	} else if queued > 0 {
+		jlog.Warn("Queued jobs expired", "jobs", queued)
+	}
+
+	// The interval gives the tracker time to time out its own jobs
+	stale, err := repository.TimeOutStaleJobs(time.Now().Add(-getExpiryInterval()), tracker.RequestErrorTimeout)
+	if err != nil {
+		jlog.Error("Failed to time out stale jobs", "error", err)
+	} else if stale > 0 {
+		jlog.Warn("Stale jobs timed out", "jobs", stale)
+	}
+}
+
+// Progress marks the job running when the node reports progress on it,
+// requests that are not jobs are ignored.
+func Progress(nodeID models.UUID, progress *models.FromNodeProgress) {
+	id, err := uuid.Parse(progress.RequestID)
+	if err != nil {
+		return
+	}
+	job, err := repository.GetJob(id)
+	if err != nil || job.NodeID != nodeID {
+		return
+	}
+	fields := map[string]any{
+		"progress":    repository.NewJSON(map[string]any(progress.Data)),
+		"deadline_at": time.Now().Add(timeoutOf(job)),
+	}
+	if job.StartedAt == nil {
+		fields["started_at"] = time.Now()
+	}
+	if _, err := repository.UpdateJobState(id, []string{repository.JobStateSent, repository.JobStateRunning}, repository.JobStateRunning, fields); err != nil {
+		jlog.Error("Failed to update job", "error", err, "jobId", id)
+	}
+}
+
+// send dispatches a queued job, it returns false when the node is gone and
+// the job stays queued.
+func send(job *repository.Job) bool {
+	queued := []string{repository.JobStateQueued}
+	// The job is marked sent first, the node may answer before Send returns
+	timeout := timeoutOf(job)
+	ok, err := repository.UpdateJobState(job.ID, queued, repository.JobStateSent, map[string]any{
+		"sent_at":     time.Now(),
+		"deadline_at": time.Now().Add(timeout),
+	})
+	if err != nil {
+		jlog.Error("Failed to update job", "error", err, "jobId", job.ID)
+		return true
+	}
+	if !ok {
+		return true
+	}
+
+	err = dispatch.Send(job.ID.String(), job.NodeID, job.Command, job.Args.Val, timeout, func(response *models.ToCloudResponse) {
+		finish(job.ID, response, []string{repository.JobStateSent, repository.JobStateRunning})
+	})
+	if errors.Is(err, connections.ErrNotConnected) || errors.Is(err, connections.ErrSessionClosed) {
+		jlog.Warn("Node disconnected before job was sent, keeping it queued", "jobId", job.ID, "nodeId", job.NodeID)
+		if _, err := repository.UpdateJobState(job.ID, []string{repository.JobStateSent}, repository.JobStateQueued, map[string]any{"sent_at": nil, "deadline_at": nil}); err != nil {
+			jlog.Error("Failed to update job", "error", err, "jobId", job.ID)
+		}
+		return false
+	}
+	if err != nil {
+		jlog.Error("Failed to send job", "error", err, "jobId", job.ID, "nodeId", job.NodeID)
+		finish(job.ID, &models.ToCloudResponse{RequestError: err.Error()}, []string{repository.JobStateSent})
+		return true
+	}
+	jlog.Info("Job sent", "jobId", job.ID, "nodeId", job.NodeID, "command", job.Command)
+	return true
+}
+
+func finish(id models.UUID, response *models.ToCloudResponse, from []string) {
+	state := repository.JobStateSucceeded
+	switch {
+	case response.RequestError == tracker.RequestErrorTimeout || response.RequestError == RequestErrorQueueExpired:
+		state = repository.JobStateTimedOut
+	case response.RequestError != "" || response.CommandError != "":
+		state = repository.JobStateFailed
+	}
+
+	ok, err := repository.UpdateJobState(id, from, state, map[string]any{
+		"data":          repository.NewJSON(map[string]any(response.Data)),
+		"request_error": response.RequestError,
+		"command_error": response.CommandError,
+		"finished_at":   time.Now(),
+	})
+	if err != nil {
+		jlog.Error("Failed to update job", "error", err, "jobId", id)
+		return
+	}
+	if ok {
+		jlog.Info("Job finished", "jobId", id, "state", state)
+	}
+}
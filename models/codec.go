@@ -0,0 +1,92 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	EncodingJSON        = "json"
+	EncodingMessagePack = "msgpack"
+)
+
+// Codec encodes messages exchanged with nodes. JSON is used unless the node
+// negotiates another encoding in the handshake.
+type Codec interface {
+	Name() string
+	// Binary codecs are sent in binary websocket frames
+	Binary() bool
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return EncodingJSON
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type messagePackCodec struct {
+	handle *codec.MsgpackHandle
+}
+
+func newMessagePackCodec() *messagePackCodec {
+	handle := &codec.MsgpackHandle{}
+	handle.WriteExt = true
+	handle.RawToString = true
+	handle.MapType = reflect.TypeOf(JsonMap(nil))
+	return &messagePackCodec{handle: handle}
+}
+
+func (c *messagePackCodec) Name() string {
+	return EncodingMessagePack
+}
+
+func (c *messagePackCodec) Binary() bool {
+	return true
+}
+
+func (c *messagePackCodec) Marshal(v any) ([]byte, error) {
+	var out []byte
+	err := codec.NewEncoderBytes(&out, c.handle).Encode(v)
+	return out, err
+}
+
+func (c *messagePackCodec) Unmarshal(data []byte, v any) error {
+	return codec.NewDecoderBytes(data, c.handle).Decode(v)
+}
+
+var (
+	JSONCodec        Codec = jsonCodec{}
+	MessagePackCodec Codec = newMessagePackCodec()
+
+	codecs = map[string]Codec{
+		EncodingJSON:        JSONCodec,
+		EncodingMessagePack: MessagePackCodec,
+	}
+)
+
+// NegotiateCodec picks the first encoding from the node preference list the
+// connector supports, JSON is used if there is none.
+func NegotiateCodec(preferred []string) Codec {
+	for _, name := range preferred {
+		if c, ok := codecs[name]; ok {
+			return c
+		}
+	}
+	return JSONCodec
+}
@@ -0,0 +1,130 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+var codecTests = []Codec{JSONCodec, MessagePackCodec}
+
+// sameJSON compares values by their JSON encoding, codecs decode numbers to
+// different types.
+func sameJSON(t *testing.T, got, want any) {
+	t.Helper()
+	gotJSON, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("got %s, want %s", gotJSON, wantJSON)
+	}
+}
+
+func TestCodecRequestRoundTrip(t *testing.T) {
+	request := &ToNodeRequest{
+		RequestID: "3f0c6c4e-8a3e-4c1e-9d55-1f0c1f4e2a10",
+		Command:   "interface.set",
+		Args: JsonMap{
+			"name":    "eth0",
+			"mtu":     1500,
+			"enabled": true,
+			"dns":     []any{"1.1.1.1", "8.8.8.8"},
+			"vlan":    JsonMap{"id": 10, "tagged": false},
+		},
+	}
+	for _, c := range codecTests {
+		t.Run(c.Name(), func(t *testing.T) {
+			data, err := c.Marshal(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded ToNodeRequest
+			if err := c.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			sameJSON(t, &decoded, request)
+		})
+	}
+}
+
+func TestCodecResponseRoundTrip(t *testing.T) {
+	responses := []*FromNodeResponse{
+		{
+			RequestID: "3f0c6c4e-8a3e-4c1e-9d55-1f0c1f4e2a10",
+			Data: JsonMap{
+				"uptime":     123456,
+				"load":       0.25,
+				"interfaces": []any{JsonMap{"name": "eth0", "up": true}},
+			},
+		},
+		{
+			Type:      MessageTypeResponse,
+			RequestID: "b1d1f0a4-7a52-4c4e-a2a4-56f1a8c0e7d3",
+			Error:     "command failed",
+		},
+	}
+	for _, c := range codecTests {
+		t.Run(c.Name(), func(t *testing.T) {
+			for _, response := range responses {
+				data, err := c.Marshal(response)
+				if err != nil {
+					t.Fatal(err)
+				}
+				messageType, err := ParseMessageType(c, data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if messageType != MessageTypeResponse {
+					t.Errorf("got message type %q", messageType)
+				}
+				var decoded FromNodeResponse
+				if err := c.Unmarshal(data, &decoded); err != nil {
+					t.Fatal(err)
+				}
+				sameJSON(t, &decoded, response)
+			}
+		})
+	}
+}
+
+func TestMessagePackMapType(t *testing.T) {
+	data, err := MessagePackCodec.Marshal(&FromNodeResponse{
+		Data: JsonMap{"nested": JsonMap{"key": "value"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded FromNodeResponse
+	if err := MessagePackCodec.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	nested, ok := decoded.Data["nested"].(JsonMap)
+	if !ok || nested["key"] != "value" {
+		t.Errorf("got nested %#v", decoded.Data["nested"])
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	tests := []struct {
+		name      string
+		preferred []string
+		want      Codec
+	}{
+		{"nothing preferred", nil, JSONCodec},
+		{"msgpack", []string{EncodingMessagePack}, MessagePackCodec},
+		{"first supported wins", []string{EncodingJSON, EncodingMessagePack}, JSONCodec},
+		{"unknown skipped", []string{"cbor", EncodingMessagePack}, MessagePackCodec},
+		{"only unknown", []string{"cbor", "protobuf"}, JSONCodec},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NegotiateCodec(tt.preferred); got != tt.want {
+				t.Errorf("got %s, want %s", got.Name(), tt.want.Name())
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Type discriminator of messages sent by nodes, messages without a type are
+// responses from firmware that predates the envelope.
+const (
+	MessageTypeResponse = "response"
+	MessageTypeEvent    = "event"
+)
+
+const (
+	NodeEventInterfaceDown = "interface.down"
+	NodeEventInterfaceUp   = "interface.up"
+	NodeEventReboot        = "reboot"
+	NodeEventDhcpLease     = "dhcp.lease"
+	NodeEventMetrics       = "metrics"
+)
+
+var knownNodeEvents = map[string]bool{
+	NodeEventInterfaceDown: true,
+	NodeEventInterfaceUp:   true,
+	NodeEventReboot:        true,
+	NodeEventDhcpLease:     true,
+	NodeEventMetrics:       true,
+}
+
+var eventNamePattern = regexp.MustCompile(`^[a-z0-9_-]+(\.[a-z0-9_-]+)*$`)
+
+type NodeMessage struct {
+	Type string `json:"type"`
+}
+
+func ParseMessageType(c Codec, body []byte) (string, error) {
+	var message NodeMessage
+	if err := c.Unmarshal(body, &message); err != nil {
+		return "", err
+	}
+	if message.Type == "" {
+		return MessageTypeResponse, nil
+	}
+	return message.Type, nil
+}
+
+// FromNodeEvent is pushed by a node on its own, not as an answer to a
+// request.
+type FromNodeEvent struct {
+	Type      string     `json:"type"`
+	Event     string     `json:"event"`
+	Timestamp *time.Time `json:"timestamp"`
+	Data      JsonMap    `json:"data"`
+}
+
+type ToCloudEvent struct {
+	Event          string    `json:"event"`
+	NodeID         UUID      `json:"nodeId"`
+	OrganizationID UUID      `json:"organizationId"`
+	Timestamp      time.Time `json:"timestamp"`
+	ReceivedAt     time.Time `json:"receivedAt"`
+	Data           JsonMap   `json:"data"`
+}
+
+func (e *FromNodeEvent) Validate() error {
+	if e.Event == "" {
+		return fmt.Errorf("event not specified")
+	}
+
+	if !eventNamePattern.MatchString(e.Event) {
+		return fmt.Errorf("bad event name %q", e.Event)
+	}
+
+	if !knownNodeEvents[e.Event] {
+		return fmt.Errorf("unknown event %q", e.Event)
+	}
+
+	if e.Event == NodeEventMetrics && len(e.Data) == 0 {
+		return fmt.Errorf("metrics event without samples")
+	}
+
+	return nil
+}
+
+func (e *FromNodeEvent) ToCloud(nodeID UUID, organizationID UUID) *ToCloudEvent {
+	now := time.Now()
+	timestamp := now
+	if e.Timestamp != nil {
+		timestamp = *e.Timestamp
+	}
+	return &ToCloudEvent{
+		Event:          e.Event,
+		NodeID:         nodeID,
+		OrganizationID: organizationID,
+		Timestamp:      timestamp,
+		ReceivedAt:     now,
+		Data:           e.Data,
+	}
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+const (
+	EventNodeConnected    = "NodeConnected"
+	EventNodeDisconnected = "NodeDisconnected"
+)
+
+// NodePresenceEvent is published when a node connects to or disconnects
+// from the connector.
+type NodePresenceEvent struct {
+	Type           string     `json:"type"`
+	NodeID         UUID       `json:"nodeId"`
+	OrganizationID UUID       `json:"organizationId"`
+	RemoteAddress  string     `json:"remoteAddress"`
+	ConnectedAt    time.Time  `json:"connectedAt"`
+	DisconnectedAt *time.Time `json:"disconnectedAt,omitempty"`
+	Reason         string     `json:"reason,omitempty"`
+	Timestamp      time.Time  `json:"timestamp"`
+}
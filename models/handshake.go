@@ -0,0 +1,58 @@
+package models
+
+import (
+	"fmt"
+	"slices"
+)
+
+// ProtocolVersion is the newest node protocol version the connector speaks.
+const ProtocolVersion = 1
+
+const (
+	MessageTypeHello   = "hello"
+	MessageTypeWelcome = "welcome"
+)
+
+// NodeHello is the first message of a node after the websocket upgrade.
+type NodeHello struct {
+	Type            string   `json:"type"`
+	ProtocolVersion int      `json:"protocolVersion"`
+	FirmwareVersion string   `json:"firmwareVersion"`
+	Model           string   `json:"model"`
+	Commands        []string `json:"commands"`
+	// Encodings the node can use after the handshake, most preferred first
+	Encodings []string `json:"encodings,omitempty"`
+}
+
+// NodeWelcome answers the hello with the protocol version both sides speak
+// and the encoding of all following messages.
+type NodeWelcome struct {
+	Type            string `json:"type"`
+	ProtocolVersion int    `json:"protocolVersion"`
+	Encoding        string `json:"encoding"`
+}
+
+func (h *NodeHello) Validate() error {
+	if h.ProtocolVersion <= 0 {
+		return fmt.Errorf("bad protocol version %d", h.ProtocolVersion)
+	}
+
+	if slices.Contains(h.Commands, "") {
+		return fmt.Errorf("empty command advertised")
+	}
+
+	return nil
+}
+
+func (h *NodeHello) Welcome() *NodeWelcome {
+	return &NodeWelcome{
+		Type:            MessageTypeWelcome,
+		ProtocolVersion: min(h.ProtocolVersion, ProtocolVersion),
+		Encoding:        NegotiateCodec(h.Encodings).Name(),
+	}
+}
+
+// Supports reports whether the node advertised the command.
+func (h *NodeHello) Supports(command string) bool {
+	return slices.Contains(h.Commands, command)
+}
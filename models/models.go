@@ -2,6 +2,7 @@ package models
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -14,6 +15,15 @@ type FromCloudRequest struct {
 	NodeID  string  `json:"nodeId"`
 	Command string  `json:"command"`
 	Args    JsonMap `json:"args"`
+	// Optional deadline of the request, the command default is used if it's zero
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+	// Deferrable requests to offline nodes are stored and sent on reconnect
+	Deferrable       bool `json:"deferrable,omitempty"`
+	ExpiresInSeconds int  `json:"expiresInSeconds,omitempty"`
+	// How a response streamed in chunks is published, reassembled by default
+	Stream string `json:"stream,omitempty"`
+	// Sends the request to every selected node instead of NodeID
+	Selector *Selector `json:"selector,omitempty"`
 }
 type ToCloudResponse struct {
 	RequestError string  `json:"requestError"` // Connector error
@@ -27,13 +37,18 @@ type ToNodeRequest struct {
 	Args      JsonMap `json:"args"`
 }
 type FromNodeResponse struct {
+	Type      string  `json:"type,omitempty"`
 	RequestID string  `json:"requestId"`
 	Data      JsonMap `json:"data"`
 	Error     string  `json:"error"`
 }
 
 func (r *FromCloudRequest) Validate() error {
-	if r.NodeID == "" {
+	if r.Selector != nil {
+		if err := r.validateSelector(); err != nil {
+			return err
+		}
+	} else if r.NodeID == "" {
 		return fmt.Errorf("empty node id specified")
 	}
 
@@ -41,9 +56,55 @@ func (r *FromCloudRequest) Validate() error {
 		return fmt.Errorf("command not specified")
 	}
 
+	if r.TimeoutSeconds < 0 {
+		return fmt.Errorf("negative timeout specified")
+	}
+
+	if r.ExpiresInSeconds < 0 {
+		return fmt.Errorf("negative expiration specified")
+	}
+
+	if err := validateStreamMode(r.Stream); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+func (r *FromCloudRequest) validateSelector() error {
+	if r.NodeID != "" {
+		return fmt.Errorf("both node id and selector specified")
+	}
+
+	if r.Deferrable || r.Stream != "" {
+		return fmt.Errorf("deferred and streamed requests can't have a selector")
+	}
+
+	// The queue is not scoped to a user, tags alone would match nodes of
+	// every organization
+	if r.Selector.OrganizationID == "" {
+		return fmt.Errorf("selector without organization id")
+	}
+
+	return r.Selector.Validate()
+}
+
+func (r *FromCloudRequest) ParseNodeID() (UUID, error) {
+	id, err := uuid.Parse(r.NodeID)
+	if err != nil {
+		return id, fmt.Errorf("bad node id %q: %s", r.NodeID, err)
+	}
+	return id, nil
+}
+
+func (r *FromCloudRequest) Timeout() time.Duration {
+	return time.Duration(r.TimeoutSeconds) * time.Second
+}
+
+func (r *FromCloudRequest) ExpiresIn() time.Duration {
+	return time.Duration(r.ExpiresInSeconds) * time.Second
+}
+
 func (r *FromCloudRequest) ToNode(requestId string) *ToNodeRequest {
 	return &ToNodeRequest{
 		RequestID: requestId,
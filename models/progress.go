@@ -0,0 +1,23 @@
+package models
+
+import "fmt"
+
+const (
+	MessageTypeProgress = "progress"
+)
+
+// FromNodeProgress tells that a long-running command is still being executed
+// by the node, it keeps the request from timing out.
+type FromNodeProgress struct {
+	Type      string  `json:"type"`
+	RequestID string  `json:"requestId"`
+	Data      JsonMap `json:"data"`
+}
+
+func (p *FromNodeProgress) Validate() error {
+	if p.RequestID == "" {
+		return fmt.Errorf("empty request id")
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Selector targets a request at many nodes instead of one: every node of the
+// organization, narrowed to the nodes with the tag when it is set.
+type Selector struct {
+	OrganizationID string `json:"organizationId,omitempty"`
+	Tag            string `json:"tag,omitempty"`
+}
+
+func (s *Selector) Validate() error {
+	if s.OrganizationID == "" && s.Tag == "" {
+		return fmt.Errorf("empty selector specified")
+	}
+
+	if _, err := s.ParseOrganizationID(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ParseOrganizationID returns nil when the selector is not limited to an
+// organization.
+func (s *Selector) ParseOrganizationID() (*UUID, error) {
+	if s.OrganizationID == "" {
+		return nil, nil
+	}
+	id, err := uuid.Parse(s.OrganizationID)
+	if err != nil {
+		return nil, fmt.Errorf("bad organization id %q: %s", s.OrganizationID, err)
+	}
+	return &id, nil
+}
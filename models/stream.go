@@ -0,0 +1,49 @@
+package models
+
+import "fmt"
+
+const (
+	MessageTypeChunk = "chunk"
+)
+
+// Stream modes of a request whose response is streamed by the node in
+// chunks.
+const (
+	// Every chunk is published as a separate message with sequence headers
+	StreamForward = "forward"
+	// Chunks are joined and published as one response
+	StreamReassemble = "reassemble"
+)
+
+// FromNodeChunk is a part of a streamed response. Data chunks are numbered
+// from zero, the terminal frame has Final set, carries the number of data
+// chunks in Seq and the command result like a regular response.
+type FromNodeChunk struct {
+	Type      string  `json:"type"`
+	RequestID string  `json:"requestId"`
+	Seq       int     `json:"seq"`
+	Final     bool    `json:"final"`
+	Chunk     []byte  `json:"chunk"`
+	Data      JsonMap `json:"data"`
+	Error     string  `json:"error"`
+}
+
+func (c *FromNodeChunk) Validate() error {
+	if c.RequestID == "" {
+		return fmt.Errorf("empty request id")
+	}
+
+	if c.Seq < 0 {
+		return fmt.Errorf("negative sequence number %d", c.Seq)
+	}
+
+	return nil
+}
+
+func validateStreamMode(mode string) error {
+	switch mode {
+	case "", StreamForward, StreamReassemble:
+		return nil
+	}
+	return fmt.Errorf("unknown stream mode %q", mode)
+}
@@ -0,0 +1,74 @@
+package models
+
+import "fmt"
+
+// Nodes advertise this command in the handshake when they take file
+// transfers.
+const CommandFileTransfer = "file.transfer"
+
+// File transfer messages sent by the connector.
+const (
+	MessageTypeFileOffer    = "file.offer"
+	MessageTypeFileChunk    = "file.chunk"
+	MessageTypeFileComplete = "file.complete"
+)
+
+// File transfer messages sent by the node.
+const (
+	// The node takes the file and tells the offset it already has
+	MessageTypeFileAccept = "file.accept"
+	// The node stored a chunk, offset is the next byte it expects
+	MessageTypeFileAck = "file.ack"
+	// The node verified the checksum of the whole file
+	MessageTypeFileDone  = "file.done"
+	MessageTypeFileError = "file.error"
+)
+
+// Events published about transfers.
+const (
+	EventFileProgress  = "file.progress"
+	EventFileCompleted = "file.completed"
+	EventFileFailed    = "file.failed"
+)
+
+type ToNodeFile struct {
+	Type       string `json:"type"`
+	TransferID string `json:"transferId"`
+	// Set in offers
+	Name      string `json:"name,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	ChunkSize int    `json:"chunkSize,omitempty"`
+	// Checksum of the whole file in offers and completions, of the chunk
+	// data in chunks
+	Sha256 string `json:"sha256,omitempty"`
+	Offset int64  `json:"offset"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+type FromNodeFile struct {
+	Type       string `json:"type"`
+	TransferID string `json:"transferId"`
+	Offset     int64  `json:"offset"`
+	Error      string `json:"error"`
+}
+
+func IsFileMessage(messageType string) bool {
+	switch messageType {
+	case MessageTypeFileAccept, MessageTypeFileAck, MessageTypeFileDone, MessageTypeFileError:
+		return true
+	}
+	return false
+}
+
+func (f *FromNodeFile) Validate() error {
+	if f.TransferID == "" {
+		return fmt.Errorf("empty transfer id")
+	}
+
+	if f.Offset < 0 {
+		return fmt.Errorf("negative offset %d", f.Offset)
+	}
+
+	return nil
+}
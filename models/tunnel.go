@@ -0,0 +1,72 @@
+package models
+
+import "fmt"
+
+// Nodes advertise this command in the handshake when they can open tunnels.
+const CommandTunnel = "tunnel"
+
+const (
+	// Sent by the connector to open a tunnel
+	MessageTypeTunnelOpen = "tunnel.open"
+	// Sent by the node once the tunnel is open
+	MessageTypeTunnelOpened = "tunnel.opened"
+	// Sent in both directions
+	MessageTypeTunnelData  = "tunnel.data"
+	MessageTypeTunnelClose = "tunnel.close"
+)
+
+const (
+	TunnelKindShell = "shell"
+	TunnelKindTCP   = "tcp"
+)
+
+// TunnelMessage is a frame of a tunnel multiplexed over the node connection.
+// Data frames are numbered from zero in each direction, as the receiver may
+// handle frames concurrently.
+type TunnelMessage struct {
+	Type     string `json:"type"`
+	TunnelID string `json:"tunnelId"`
+	// Set in open frames
+	Kind string `json:"kind,omitempty"`
+	Host string `json:"host,omitempty"`
+	Port int    `json:"port,omitempty"`
+	// Set in data frames
+	Seq  int    `json:"seq"`
+	Data []byte `json:"data,omitempty"`
+	// Set in close frames
+	Reason string `json:"reason,omitempty"`
+}
+
+func IsTunnelMessage(messageType string) bool {
+	switch messageType {
+	case MessageTypeTunnelOpened, MessageTypeTunnelData, MessageTypeTunnelClose:
+		return true
+	}
+	return false
+}
+
+func (m *TunnelMessage) Validate() error {
+	if m.TunnelID == "" {
+		return fmt.Errorf("empty tunnel id")
+	}
+
+	if m.Seq < 0 {
+		return fmt.Errorf("negative sequence number %d", m.Seq)
+	}
+
+	return nil
+}
+
+// ValidateTunnelTarget checks the kind and the port of a tunnel to open.
+func ValidateTunnelTarget(kind string, port int) error {
+	switch kind {
+	case TunnelKindShell:
+		return nil
+	case TunnelKindTCP:
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("bad port %d", port)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown tunnel kind %q", kind)
+}
@@ -0,0 +1,141 @@
+package queue
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/zarinit-routers/cloud-connector/config"
+)
+
+const (
+	ENV_DEAD_LETTER_EXCHANGE = "DEAD_LETTER_EXCHANGE"
+	ENV_DEAD_LETTER_QUEUE    = "DEAD_LETTER_QUEUE"
+
+	HeaderDeadLetterReason = "x-dead-letter-reason"
+	HeaderDeadLetterError  = "x-dead-letter-error"
+	HeaderDeadLetteredAt   = "x-dead-lettered-at"
+	HeaderReplayed         = "x-replayed"
+)
+
+const (
+	ReasonMalformed            = "malformed"
+	ReasonInvalid              = "invalid"
+	ReasonMissingCorrelationID = "missing-correlation-id"
+)
+
+func getDeadLetterExchange() string {
+	return config.String(ENV_DEAD_LETTER_EXCHANGE, "requests.dead-letter")
+}
+
+func getDeadLetterQueue() string {
+	return config.String(ENV_DEAD_LETTER_QUEUE, "requests.dead-letter")
+}
+
+// DeadLetterError marks a request that can never be handled, the request is
+// routed to the dead-letter exchange before an error is replied.
+type DeadLetterError struct {
+	Reason string
+	Err    error
+}
+
+func (e *DeadLetterError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DeadLetterError) Unwrap() error {
+	return e.Err
+}
+
+func DeadLetter(reason string, err error) error {
+	return &DeadLetterError{Reason: reason, Err: err}
+}
+
+// DeadLetterHandlerFunc is called for every dead-lettered request.
+type DeadLetterHandlerFunc func(msg *amqp.Delivery, reason string, err error)
+
+var deadLetterHandlers = []DeadLetterHandlerFunc{}
+
+func AddDeadLetterHandler(h DeadLetterHandlerFunc) {
+	deadLetterHandlers = append(deadLetterHandlers, h)
+}
+
+func setupDeadLetterExchange(channel *amqp.Channel) error {
+	err := channel.ExchangeDeclare(
+		getDeadLetterExchange(), // name
+		"fanout",                // type
+		true,                    // durable
+		false,                   // auto-deleted
+		false,                   // internal
+		false,                   // no-wait
+		nil,                     // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare dead-letter exchange: %s", err)
+	}
+
+	// Keeps dead letters until they are inspected, the exchange alone would
+	// drop them
+	_, err = channel.QueueDeclare(
+		getDeadLetterQueue(), // name
+		true,                 // durable
+		false,                // delete when unused
+		false,                // exclusive
+		false,                // no-wait
+		nil,                  // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare dead-letter queue: %s", err)
+	}
+	if err := channel.QueueBind(getDeadLetterQueue(), "", getDeadLetterExchange(), false, nil); err != nil {
+		return fmt.Errorf("failed to bind dead-letter queue: %s", err)
+	}
+	return nil
+}
+
+func deadLetter(msg *amqp.Delivery, dl *DeadLetterError) {
+	log.Warn("Dead-lettering request", "correlationId", msg.CorrelationId, "reason", dl.Reason, "error", dl.Err)
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[HeaderDeadLetterReason] = dl.Reason
+	headers[HeaderDeadLetterError] = dl.Err.Error()
+	headers[HeaderDeadLetteredAt] = time.Now().UTC().Format(time.RFC3339)
+
+	err := publish(outgoing{
+		exchange: getDeadLetterExchange(),
+		publishing: amqp.Publishing{
+			Headers:       headers,
+			ContentType:   msg.ContentType,
+			DeliveryMode:  amqp.Persistent,
+			CorrelationId: msg.CorrelationId,
+			ReplyTo:       msg.ReplyTo,
+			Body:          msg.Body,
+		},
+	})
+	if err != nil {
+		log.Error("Failed to publish dead letter", "correlationId", msg.CorrelationId, "error", err)
+	}
+
+	for _, handler := range deadLetterHandlers {
+		handler(msg, dl.Reason, dl.Err)
+	}
+}
+
+// Replay publishes a dead-lettered request to the requests queue again.
+func Replay(route Route, contentType string, body []byte) error {
+	return publish(outgoing{
+		routingKey: requestsQueue,
+		publishing: amqp.Publishing{
+			Headers:       amqp.Table{HeaderReplayed: true},
+			ContentType:   contentType,
+			DeliveryMode:  amqp.Persistent,
+			CorrelationId: route.RequestID,
+			ReplyTo:       route.ReplyTo,
+			Body:          body,
+		},
+	})
+}
@@ -0,0 +1,60 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/zarinit-routers/cloud-connector/config"
+	"github.com/zarinit-routers/cloud-connector/models"
+)
+
+const (
+	ENV_PRESENCE_EXCHANGE = "PRESENCE_EXCHANGE"
+	ENV_EVENTS_EXCHANGE   = "EVENTS_EXCHANGE"
+)
+
+func getPresenceExchange() string {
+	return config.String(ENV_PRESENCE_EXCHANGE, "nodes.presence")
+}
+
+func getEventsExchange() string {
+	return config.String(ENV_EVENTS_EXCHANGE, "nodes.events")
+}
+
+func setupEventExchanges(channel *amqp.Channel) error {
+	if err := declareTopicExchange(channel, getPresenceExchange()); err != nil {
+		return err
+	}
+	return declareTopicExchange(channel, getEventsExchange())
+}
+
+func publishEvent(exchange string, routingKey string, event any) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %s", err)
+	}
+	return publish(outgoing{
+		exchange:   exchange,
+		routingKey: routingKey,
+		publishing: amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		},
+	})
+}
+
+// PublishPresence publishes the event to the presence exchange with a
+// routing key like "org.<organizationId>.node.<nodeId>.connected".
+func PublishPresence(event *models.NodePresenceEvent) error {
+	name := strings.ToLower(strings.TrimPrefix(event.Type, "Node"))
+	return publishEvent(getPresenceExchange(), RoutingKey(event.OrganizationID, event.NodeID, name), event)
+}
+
+// PublishNodeEvent publishes the event to the events exchange with a routing
+// key like "org.<organizationId>.node.<nodeId>.interface.down".
+func PublishNodeEvent(event *models.ToCloudEvent) error {
+	return publishEvent(getEventsExchange(), RoutingKey(event.OrganizationID, event.NodeID, event.Event), event)
+}
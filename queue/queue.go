@@ -2,26 +2,57 @@ package queue
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/charmbracelet/log"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/zarinit-routers/cloud-connector/config"
 	"github.com/zarinit-routers/cloud-connector/models"
 )
 
 var (
-	conn      *amqp.Connection
-	channel   *amqp.Channel
-	requests  amqp.Queue
-	responses amqp.Queue
+	// mu guards the connection state, it is replaced on every reconnect
+	mu      sync.RWMutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
 )
 
 const (
-	ENV_RABBITMQ_URL = "RABBITMQ_URL"
+	requestsQueue  = "requests"
+	responsesQueue = "responses"
+	// Requeued requests wait here until their expiration, then they are
+	// dead-lettered back to the requests queue
+	requestsDelayQueue = "requests.delay"
 )
 
+const (
+	HeaderSequence = "x-sequence"
+	HeaderFinal    = "x-final"
+	// HeaderRequeueCount counts how many times a request was returned to the
+	// requests queue
+	HeaderRequeueCount = "x-requeue-count"
+)
+
+const (
+	ENV_RABBITMQ_URL           = "RABBITMQ_URL"
+	ENV_RABBITMQ_PREFETCH      = "RABBITMQ_PREFETCH"
+	ENV_RABBITMQ_REQUEUE_LIMIT = "RABBITMQ_REQUEUE_LIMIT"
+	ENV_RABBITMQ_REQUEUE_DELAY = "RABBITMQ_REQUEUE_DELAY"
+)
+
+func getRequeueLimit() int {
+	return config.Int(ENV_RABBITMQ_REQUEUE_LIMIT, 5)
+}
+
+func getRequeueDelay() time.Duration {
+	return config.Duration(ENV_RABBITMQ_REQUEUE_DELAY, time.Second)
+}
+
 func getRabbitMQUrl() string {
 	url := os.Getenv(ENV_RABBITMQ_URL)
 	if url == "" {
@@ -31,134 +62,247 @@ func getRabbitMQUrl() string {
 	return url
 }
 
+// MessageHandlerFunc handles a request delivery. The delivery is acked
+// after all handlers return, an error is replied to the cloud first, unless
+// it was wrapped with Requeue.
 type MessageHandlerFunc func(*amqp.Delivery) error
 
-var (
-	messageHandlers = []MessageHandlerFunc{}
-)
+// RequeueError asks to return the delivery to the queue instead of replying
+// an error, so another connector instance can handle it. The delivery comes
+// back with an incremented requeue count after the requeue delay.
+type RequeueError struct {
+	Err error
+}
 
-func AddHandler(h MessageHandlerFunc) {
-	messageHandlers = append(messageHandlers, h)
+func (e *RequeueError) Error() string {
+	return e.Err.Error()
 }
 
-func Serve() {
-	url := getRabbitMQUrl()
-	if connection, err := amqp.Dial(url); err != nil {
-		log.Fatal("Failed to connect to RabbitMQ", "error", err)
-	} else {
-		conn = connection
-	}
-	log.Info("Connected to RabbitMQ")
-	defer conn.Close()
+func (e *RequeueError) Unwrap() error {
+	return e.Err
+}
 
-	if ch, err := conn.Channel(); err != nil {
-		log.Fatal("Failed to open a channel", "error", err)
-	} else {
-		channel = ch
-	}
+func Requeue(err error) error {
+	return &RequeueError{Err: err}
+}
 
-	if req, res, err := setupQueues(channel); err != nil {
-		log.Fatal("Failed to setup queues", "error", err)
-	} else {
-		requests = req
-		responses = res
+// RequeueCount returns how many times the delivery was already requeued.
+func RequeueCount(msg *amqp.Delivery) int {
+	switch count := msg.Headers[HeaderRequeueCount].(type) {
+	case int:
+		return count
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
 	}
+	return 0
+}
 
-	messages, err := channel.Consume(
-		requests.Name, // queue
-		"",            // consumer
-		true,          // auto-ack
-		false,         // exclusive
-		false,         // no-local
-		false,         // no-wait
-		nil,           // args
-	)
+// CanRequeue reports whether the delivery is below the requeue limit.
+func CanRequeue(msg *amqp.Delivery) bool {
+	return RequeueCount(msg) < getRequeueLimit()
+}
 
-	if err != nil {
-		log.Fatal("Failed to register a consumer", "error", err)
+// requeue publishes a copy of the delivery to the delay queue and acks the
+// original one, the copy expires into the requests queue after the requeue
+// delay. Unlike a nack, the copy doesn't go straight back to the same
+// consumer and carries the requeue count.
+func requeue(msg *amqp.Delivery) error {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
 	}
+	headers[HeaderRequeueCount] = int32(RequeueCount(msg) + 1)
 
-	for m := range messages {
-		go handleMessage(&m)
+	err := publish(outgoing{
+		routingKey: requestsDelayQueue,
+		publishing: amqp.Publishing{
+			Headers:       headers,
+			ContentType:   msg.ContentType,
+			DeliveryMode:  amqp.Persistent,
+			CorrelationId: msg.CorrelationId,
+			ReplyTo:       msg.ReplyTo,
+			Expiration:    strconv.FormatInt(getRequeueDelay().Milliseconds(), 10),
+			Body:          msg.Body,
+		},
+	})
+	if err != nil {
+		log.Error("Failed to requeue message, returning it to the queue", "correlationId", msg.CorrelationId, "error", err)
+		return msg.Nack(false, true)
 	}
+	return msg.Ack(false)
+}
+
+var (
+	messageHandlers = []MessageHandlerFunc{}
+)
+
+func AddHandler(h MessageHandlerFunc) {
+	messageHandlers = append(messageHandlers, h)
 }
 
 func handleMessage(msg *amqp.Delivery) error {
 
 	wg := sync.WaitGroup{}
+	errs := make([]error, len(messageHandlers))
 
-	for _, handler := range messageHandlers {
+	for i, handler := range messageHandlers {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := handler(msg); err != nil {
-				log.Error("Error while handling message, sending internal error back", "correlationId", msg.CorrelationId, "error", err)
-				sendError(msg.CorrelationId, err)
-			}
+			errs[i] = handler(msg)
 		}()
 	}
+	wg.Wait()
+
+	for _, err := range errs {
+		var requeueErr *RequeueError
+		if errors.As(err, &requeueErr) {
+			log.Warn("Returning message to the queue", "correlationId", msg.CorrelationId, "requeueCount", RequeueCount(msg), "error", err)
+			return requeue(msg)
+		}
+	}
 
-	return nil
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		var dl *DeadLetterError
+		if errors.As(err, &dl) {
+			deadLetter(msg, dl)
+		}
+		if msg.CorrelationId == "" {
+			log.Error("Error while handling message without correlation id, dropping it", "error", err)
+			continue
+		}
+		log.Error("Error while handling message, sending internal error back", "correlationId", msg.CorrelationId, "error", err)
+		if err := sendError(RouteOf(msg), err); err != nil {
+			log.Error("Failed to send error response, returning message to the queue", "correlationId", msg.CorrelationId, "error", err)
+			return msg.Nack(false, true)
+		}
+	}
+
+	return msg.Ack(false)
 }
 
 func BadRequestBodyErr(err error) error {
 	return fmt.Errorf("bad request body: %s", err)
 }
 
-func sendError(requestId string, err error) error {
-	log.Error("Sending error response", "error", err, "requestId", requestId)
+func sendError(route Route, err error) error {
+	log.Error("Sending error response", "error", err, "requestId", route.RequestID, "replyTo", route.ReplyTo)
 	response := &models.ToCloudResponse{
 		RequestError: err.Error(),
 	}
 
-	return SendResponse(requestId, response)
+	return SendResponse(route, response)
 }
 
 func setupQueues(channel *amqp.Channel) (requests amqp.Queue, responses amqp.Queue, err error) {
 
 	requests, err = channel.QueueDeclare(
-		"requests", // name
-		false,      // durable
-		false,      // delete when unused
-		false,      // exclusive
-		false,      // no-wait
-		nil,        // arguments
+		requestsQueue, // name
+		true,          // durable
+		false,         // delete when unused
+		false,         // exclusive
+		false,         // no-wait
+		nil,           // arguments
+	)
+	if err != nil {
+		return requests, responses, fmt.Errorf("failed to declare a queue: %s", err)
+	}
+
+	_, err = channel.QueueDeclare(
+		requestsDelayQueue, // name
+		true,               // durable
+		false,              // delete when unused
+		false,              // exclusive
+		false,              // no-wait
+		amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": requestsQueue,
+		}, // arguments
 	)
 	if err != nil {
-		log.Fatal("Failed to declare a queue", "error", err)
-		return requests, responses, err
+		return requests, responses, fmt.Errorf("failed to declare a queue: %s", err)
 	}
 
 	responses, err = channel.QueueDeclare(
-		"responses", // name
-		false,       // durable
-		false,       // delete when unused
-		false,       // exclusive
-		false,       // no-wait
-		nil,         // arguments
+		responsesQueue, // name
+		true,           // durable
+		false,          // delete when unused
+		false,          // exclusive
+		false,          // no-wait
+		nil,            // arguments
 	)
 	if err != nil {
-		log.Fatal("Failed to declare a queue", "error", err)
-		return requests, responses, err
+		return requests, responses, fmt.Errorf("failed to declare a queue: %s", err)
 	}
 
 	return requests, responses, nil
 }
 
-func SendResponse(requestId string, response *models.ToCloudResponse) error {
+// Route addresses a response to the cloud service that sent the request.
+type Route struct {
+	RequestID string
+	// Queue named in the ReplyTo property of the request, responses go to
+	// the responses exchange or queue when it is empty
+	ReplyTo string
+
+	// Used to build the routing key on the responses exchange
+	OrganizationID models.UUID
+	NodeID         models.UUID
+	Command        string
+}
+
+func (r Route) RoutingKey() string {
+	return RoutingKey(r.OrganizationID, r.NodeID, r.Command)
+}
+
+func RouteOf(msg *amqp.Delivery) Route {
+	return Route{
+		RequestID: msg.CorrelationId,
+		ReplyTo:   msg.ReplyTo,
+	}
+}
+
+// SendResponse publishes the response, while the connector is disconnected
+// from RabbitMQ it is buffered until the connection is recovered.
+func SendResponse(route Route, response *models.ToCloudResponse) error {
+	return sendResponse(route, nil, response)
+}
+
+// SendResponsePart publishes a part of a streamed response, consumers
+// restore the order by the sequence header and stop on the final part.
+func SendResponsePart(route Route, seq int, final bool, response *models.ToCloudResponse) error {
+	return sendResponse(route, amqp.Table{
+		HeaderSequence: seq,
+		HeaderFinal:    final,
+	}, response)
+}
+
+func sendResponse(route Route, headers amqp.Table, response *models.ToCloudResponse) error {
 	body, err := json.Marshal(response)
 	if err != nil {
 		return err
 	}
-	return channel.Publish(
-		"",             // exchange
-		responses.Name, // routing key
-		false,          // mandatory
-		false,          // immediate
-		amqp.Publishing{
+	exchange, routingKey := "", route.ReplyTo
+	if routingKey == "" {
+		exchange, routingKey = getResponsesExchange(), responsesQueue
+		if exchange != "" {
+			routingKey = route.RoutingKey()
+		}
+	}
+	return publish(outgoing{
+		exchange:   exchange,
+		routingKey: routingKey,
+		publishing: amqp.Publishing{
+			Headers:       headers,
 			ContentType:   "application/json",
-			CorrelationId: requestId,
+			DeliveryMode:  amqp.Persistent,
+			CorrelationId: route.RequestID,
 			Body:          body,
 		},
-	)
+	})
 }
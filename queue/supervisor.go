@@ -0,0 +1,170 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/zarinit-routers/cloud-connector/config"
+)
+
+const (
+	ENV_RABBITMQ_MIN_BACKOFF    = "RABBITMQ_MIN_BACKOFF"
+	ENV_RABBITMQ_MAX_BACKOFF    = "RABBITMQ_MAX_BACKOFF"
+	ENV_RABBITMQ_PUBLISH_BUFFER = "RABBITMQ_PUBLISH_BUFFER"
+)
+
+var ErrDisconnected = errors.New("disconnected from RabbitMQ and publish buffer is full")
+
+type outgoing struct {
+	exchange   string
+	routingKey string
+	publishing amqp.Publishing
+}
+
+var (
+	// pending holds messages published while the connector is disconnected
+	pendingMu sync.Mutex
+	pending   []outgoing
+)
+
+// Serve keeps the connector connected to RabbitMQ. When the connection or
+// the channel is closed it reconnects with exponential backoff, declares the
+// topology again and resumes consuming.
+func Serve() {
+	url := getRabbitMQUrl()
+	minBackoff := config.Duration(ENV_RABBITMQ_MIN_BACKOFF, time.Second)
+	maxBackoff := config.Duration(ENV_RABBITMQ_MAX_BACKOFF, time.Minute)
+
+	backoff := minBackoff
+	for {
+		connected, err := serveConnection(url)
+		if connected {
+			backoff = minBackoff
+		}
+		log.Error("RabbitMQ connection lost, reconnecting", "error", err, "retryIn", backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func serveConnection(url string) (connected bool, err error) {
+	connection, err := amqp.Dial(url)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to RabbitMQ: %s", err)
+	}
+	defer connection.Close()
+
+	ch, err := connection.Channel()
+	if err != nil {
+		return false, fmt.Errorf("failed to open a channel: %s", err)
+	}
+
+	req, _, err := setupQueues(ch)
+	if err != nil {
+		return false, fmt.Errorf("failed to setup queues: %s", err)
+	}
+
+	if err := setupDeadLetterExchange(ch); err != nil {
+		return false, err
+	}
+
+	if err := setupResponsesExchange(ch); err != nil {
+		return false, err
+	}
+
+	if err := setupEventExchanges(ch); err != nil {
+		return false, err
+	}
+
+	if err := ch.Qos(config.Int(ENV_RABBITMQ_PREFETCH, 32), 0, false); err != nil {
+		return false, fmt.Errorf("failed to set channel QoS: %s", err)
+	}
+
+	messages, err := ch.Consume(
+		req.Name, // queue
+		"",       // consumer
+		false,    // auto-ack
+		false,    // exclusive
+		false,    // no-local
+		false,    // no-wait
+		nil,      // args
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to register a consumer: %s", err)
+	}
+
+	connectionClosed := connection.NotifyClose(make(chan *amqp.Error, 1))
+	channelClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	mu.Lock()
+	conn = connection
+	channel = ch
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		conn = nil
+		channel = nil
+		mu.Unlock()
+	}()
+
+	log.Info("Connected to RabbitMQ")
+	flushPending()
+
+	for {
+		select {
+		case m, ok := <-messages:
+			if !ok {
+				return true, fmt.Errorf("consumer stopped")
+			}
+			go handleMessage(&m)
+		case err := <-connectionClosed:
+			return true, fmt.Errorf("connection closed: %v", err)
+		case err := <-channelClosed:
+			return true, fmt.Errorf("channel closed: %v", err)
+		}
+	}
+}
+
+// publish sends the message right away when connected, otherwise it is
+// buffered. When the buffer is full ErrDisconnected is returned.
+func publish(m outgoing) error {
+	mu.RLock()
+	ch := channel
+	mu.RUnlock()
+
+	if ch != nil {
+		err := ch.Publish(m.exchange, m.routingKey, false, false, m.publishing)
+		if err == nil || !errors.Is(err, amqp.ErrClosed) {
+			return err
+		}
+	}
+
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	if len(pending) >= config.Int(ENV_RABBITMQ_PUBLISH_BUFFER, 1000) {
+		return ErrDisconnected
+	}
+	pending = append(pending, m)
+	log.Warn("RabbitMQ is not connected, message buffered", "correlationId", m.publishing.CorrelationId, "buffered", len(pending))
+	return nil
+}
+
+func flushPending() {
+	pendingMu.Lock()
+	messages := pending
+	pending = nil
+	pendingMu.Unlock()
+
+	if len(messages) > 0 {
+		log.Info("Publishing buffered messages", "count", len(messages))
+	}
+	for _, m := range messages {
+		if err := publish(m); err != nil {
+			log.Error("Failed to publish buffered message", "correlationId", m.publishing.CorrelationId, "error", err)
+		}
+	}
+}
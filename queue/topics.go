@@ -0,0 +1,78 @@
+package queue
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/zarinit-routers/cloud-connector/config"
+	"github.com/zarinit-routers/cloud-connector/models"
+)
+
+const (
+	ENV_RESPONSES_EXCHANGE = "RESPONSES_EXCHANGE"
+
+	unknownRoutingWord = "unknown"
+)
+
+// getResponsesExchange returns the topic exchange for responses, responses
+// are published straight to the responses queue when it is not configured.
+func getResponsesExchange() string {
+	return config.String(ENV_RESPONSES_EXCHANGE, "")
+}
+
+// RoutingKey builds a topic routing key in the form
+// "org.<organizationId>.node.<nodeId>.<name>", unknown parts are replaced
+// with "unknown" so the key always has the same shape.
+func RoutingKey(organizationID models.UUID, nodeID models.UUID, name string) string {
+	return fmt.Sprintf("org.%s.node.%s.%s", routingWord(organizationID), routingWord(nodeID), routingName(name))
+}
+
+func routingWord(id models.UUID) string {
+	if id == uuid.Nil {
+		return unknownRoutingWord
+	}
+	return id.String()
+}
+
+func routingName(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return unknownRoutingWord
+	}
+	return strings.NewReplacer("*", "_", "#", "_").Replace(name)
+}
+
+func declareTopicExchange(channel *amqp.Channel, name string) error {
+	err := channel.ExchangeDeclare(
+		name,    // name
+		"topic", // type
+		true,    // durable
+		false,   // auto-deleted
+		false,   // internal
+		false,   // no-wait
+		nil,     // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare exchange %q: %s", name, err)
+	}
+	return nil
+}
+
+// setupResponsesExchange declares the responses exchange and binds the
+// shared responses queue to every key, so its consumers keep receiving all
+// responses.
+func setupResponsesExchange(channel *amqp.Channel) error {
+	exchange := getResponsesExchange()
+	if exchange == "" {
+		return nil
+	}
+	if err := declareTopicExchange(channel, exchange); err != nil {
+		return err
+	}
+	if err := channel.QueueBind(responsesQueue, "#", exchange, false, nil); err != nil {
+		return fmt.Errorf("failed to bind responses queue: %s", err)
+	}
+	return nil
+}
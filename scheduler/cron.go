@@ -0,0 +1,241 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed five field cron expression: minute, hour, day of month,
+// month and day of week. Fields take "*", numbers, ranges "a-b", steps "/n"
+// and lists "a,b", months and days of week also take names like "jan" and
+// "mon". Expressions like "@daily" are accepted too.
+type Cron struct {
+	minute, hour, dom, month, dow uint64
+	// Day of month and day of week restricted at once match either of them
+	domAny, dowAny bool
+}
+
+var aliases = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dowNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+type bounds struct {
+	min, max int
+	names    []string
+	// First name maps to that value
+	namesFrom int
+}
+
+var (
+	minuteBounds = bounds{min: 0, max: 59}
+	hourBounds   = bounds{min: 0, max: 23}
+	domBounds    = bounds{min: 1, max: 31}
+	monthBounds  = bounds{min: 1, max: 12, names: monthNames, namesFrom: 1}
+	// 7 is Sunday as well as 0
+	dowBounds = bounds{min: 0, max: 7, names: dowNames, namesFrom: 0}
+)
+
+func ParseCron(expression string) (*Cron, error) {
+	expression = strings.TrimSpace(strings.ToLower(expression))
+	if alias, ok := aliases[expression]; ok {
+		expression = alias
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields in cron expression %q, got %d", expression, len(fields))
+	}
+
+	var c Cron
+	var err error
+	if c.minute, err = parseField(fields[0], minuteBounds); err != nil {
+		return nil, fmt.Errorf("bad minute: %s", err)
+	}
+	if c.hour, err = parseField(fields[1], hourBounds); err != nil {
+		return nil, fmt.Errorf("bad hour: %s", err)
+	}
+	if c.dom, err = parseField(fields[2], domBounds); err != nil {
+		return nil, fmt.Errorf("bad day of month: %s", err)
+	}
+	if c.month, err = parseField(fields[3], monthBounds); err != nil {
+		return nil, fmt.Errorf("bad month: %s", err)
+	}
+	if c.dow, err = parseField(fields[4], dowBounds); err != nil {
+		return nil, fmt.Errorf("bad day of week: %s", err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	// Like in Vixie cron, fields starting with "*" like "*/2" are unrestricted
+	c.domAny = strings.HasPrefix(fields[2], "*") || strings.HasPrefix(fields[2], "?")
+	c.dowAny = strings.HasPrefix(fields[4], "*") || strings.HasPrefix(fields[4], "?")
+	return &c, nil
+}
+
+// parseField returns a bit set of the values matched by the field.
+func parseField(field string, b bounds) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step %q", stepPart)
+			}
+		}
+
+		var from, to int
+		switch {
+		case rangePart == "*" || rangePart == "?":
+			from, to = b.min, b.max
+		case strings.Contains(rangePart, "-"):
+			lo, hi, _ := strings.Cut(rangePart, "-")
+			var err error
+			if from, err = parseValue(lo, b); err != nil {
+				return 0, err
+			}
+			if to, err = parseValue(hi, b); err != nil {
+				return 0, err
+			}
+			if from > to {
+				return 0, fmt.Errorf("bad range %q", rangePart)
+			}
+		default:
+			var err error
+			if from, err = parseValue(rangePart, b); err != nil {
+				return 0, err
+			}
+			to = from
+			if hasStep {
+				to = b.max
+			}
+		}
+
+		for v := from; v <= to; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func parseValue(value string, b bounds) (int, error) {
+	for i, name := range b.names {
+		if value == name {
+			return i + b.namesFrom, nil
+		}
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q", value)
+	}
+	if v < b.min || v > b.max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", v, b.min, b.max)
+	}
+	return v, nil
+}
+
+func has(set uint64, v int) bool {
+	return set&(1<<v) != 0
+}
+
+func (c *Cron) dayMatches(t time.Time) bool {
+	domMatch := has(c.dom, t.Day())
+	dowMatch := has(c.dow, int(t.Weekday()))
+	if c.domAny || c.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the first time after t matching the expression, in the
+// location of t. Zero time is returned when nothing matches in five years.
+// Times skipped by a DST change run at the first instant after the change,
+// times repeated by it run once, at their first occurrence.
+func (c *Cron) Next(t time.Time) time.Time {
+	loc := t.Location()
+	// Wall clock times are searched in UTC, which has no DST changes
+	w := wallOf(t).Add(time.Minute)
+	limit := w.AddDate(5, 0, 0)
+
+	for {
+		w = c.nextWall(w, limit)
+		if w.IsZero() {
+			return time.Time{}
+		}
+		if next := wallTime(w, loc); next.After(t) {
+			return next
+		}
+		w = w.Add(time.Minute)
+	}
+}
+
+// nextWall returns the first wall clock time from w matching the expression.
+func (c *Cron) nextWall(w, limit time.Time) time.Time {
+	for w.Before(limit) {
+		if !has(c.month, int(w.Month())) {
+			w = time.Date(w.Year(), w.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.dayMatches(w) {
+			w = time.Date(w.Year(), w.Month(), w.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !has(c.hour, w.Hour()) {
+			w = time.Date(w.Year(), w.Month(), w.Day(), w.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !has(c.minute, w.Minute()) {
+			w = w.Add(time.Minute)
+			continue
+		}
+		return w
+	}
+	return time.Time{}
+}
+
+// wallTime returns the instant the wall clock of loc shows w.
+func wallTime(w time.Time, loc *time.Location) time.Time {
+	t := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), 0, 0, loc)
+	start, end := t.ZoneBounds()
+	if !sameWall(t, w) {
+		// Skipped by a DST change, time.Date moved it to either side of the
+		// change
+		if wallOf(t).Before(w) {
+			return end
+		}
+		return start
+	}
+
+	// Repeated by a DST change, time.Date may have picked the second one
+	if !start.IsZero() {
+		_, before := start.Add(-time.Second).Zone()
+		_, after := t.Zone()
+		earlier := t.Add(time.Duration(after-before) * time.Second)
+		if earlier.Before(t) && sameWall(earlier, w) {
+			return earlier
+		}
+	}
+	return t
+}
+
+func wallOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+func sameWall(t, w time.Time) bool {
+	return wallOf(t).Equal(w)
+}
@@ -0,0 +1,126 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expression := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"foo * * * *",
+		"* * * foo *",
+		"@every",
+	} {
+		if _, err := ParseCron(expression); err == nil {
+			t.Errorf("%q: expected error", expression)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	utc := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name       string
+		expression string
+		after      time.Time
+		want       time.Time
+	}{
+		{"every minute", "* * * * *", utc(1, 1, 10, 7), utc(1, 1, 10, 8)},
+		{"seconds are dropped", "* * * * *", utc(1, 1, 10, 7).Add(30 * time.Second), utc(1, 1, 10, 8)},
+		{"step", "*/15 * * * *", utc(1, 1, 10, 7), utc(1, 1, 10, 15)},
+		{"step wraps the hour", "*/15 * * * *", utc(1, 1, 10, 50), utc(1, 1, 11, 0)},
+		{"range", "0 9-17 * * *", utc(1, 1, 17, 0), utc(1, 2, 9, 0)},
+		{"range with step", "0 9-17/4 * * *", utc(1, 1, 10, 0), utc(1, 1, 13, 0)},
+		{"value with step", "0 20/2 * * *", utc(1, 1, 21, 0), utc(1, 1, 22, 0)},
+		{"list", "0 0 1,15 * *", utc(1, 2, 0, 0), utc(1, 15, 0, 0)},
+		{"month names", "0 12 1 jul,jan *", utc(2, 1, 0, 0), utc(7, 1, 12, 0)},
+		{"day names", "0 0 * * mon-fri", utc(1, 2, 12, 0), utc(1, 5, 0, 0)},
+		{"sunday as 7", "0 0 * * 7", utc(1, 1, 0, 0), utc(1, 4, 0, 0)},
+		{"alias", "@monthly", utc(1, 15, 0, 0), utc(2, 1, 0, 0)},
+		{"dom or dow", "0 0 13 * fri", utc(1, 1, 0, 0), utc(1, 2, 0, 0)},
+		{"dom or dow, dom first", "0 0 13 * fri", utc(1, 10, 0, 0), utc(1, 13, 0, 0)},
+		{"dom step is unrestricted", "0 0 */2 * mon", utc(1, 1, 0, 0), utc(1, 5, 0, 0)},
+		{"dow step is unrestricted", "0 0 10 * */2", utc(1, 1, 0, 0), utc(1, 10, 0, 0)},
+		{"31st skips short months", "0 0 31 * *", utc(2, 1, 0, 0), utc(3, 31, 0, 0)},
+		{"last day of year", "59 23 31 12 *", utc(1, 1, 0, 0), utc(12, 31, 23, 59)},
+		{"leap day", "0 0 29 2 *", utc(3, 1, 0, 0), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"never", "0 0 30 2 *", utc(1, 1, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCron(tt.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Next(tt.after); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) of %q = %s, want %s", tt.after, tt.expression, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextDST(t *testing.T) {
+	newYork := mustLocation(t, "America/New_York")
+	berlin := mustLocation(t, "Europe/Berlin")
+	est := time.FixedZone("EST", -5*3600)
+	edt := time.FixedZone("EDT", -4*3600)
+	cet := time.FixedZone("CET", 3600)
+	cest := time.FixedZone("CEST", 2*3600)
+
+	tests := []struct {
+		name       string
+		expression string
+		loc        *time.Location
+		after      time.Time
+		want       time.Time
+	}{
+		// Clocks go from 02:00 to 03:00 on 2026-03-08 in New York
+		{"skipped time runs after the change", "30 2 * * *", newYork, time.Date(2026, 3, 8, 0, 0, 0, 0, newYork), time.Date(2026, 3, 8, 3, 0, 0, 0, edt)},
+		{"skipped hour runs after the change", "0 * * * *", newYork, time.Date(2026, 3, 8, 1, 0, 0, 0, newYork), time.Date(2026, 3, 8, 3, 0, 0, 0, edt)},
+		{"skipped time runs once", "*/15 2 * * *", newYork, time.Date(2026, 3, 8, 3, 0, 0, 0, newYork), time.Date(2026, 3, 9, 2, 0, 0, 0, edt)},
+		{"day after the change", "30 2 * * *", newYork, time.Date(2026, 3, 8, 3, 0, 0, 0, newYork), time.Date(2026, 3, 9, 2, 30, 0, 0, edt)},
+		// Clocks go from 02:00 to 03:00 on 2026-03-29 in Berlin
+		{"skipped time in Berlin", "30 2 * * *", berlin, time.Date(2026, 3, 29, 0, 0, 0, 0, berlin), time.Date(2026, 3, 29, 3, 0, 0, 0, cest)},
+		// Clocks go from 02:00 back to 01:00 on 2026-11-01 in New York
+		{"repeated time runs at first occurrence", "30 1 * * *", newYork, time.Date(2026, 11, 1, 0, 0, 0, 0, newYork), time.Date(2026, 11, 1, 1, 30, 0, 0, edt)},
+		{"repeated time runs once", "30 1 * * *", newYork, time.Date(2026, 11, 1, 1, 10, 0, 0, est), time.Date(2026, 11, 2, 1, 30, 0, 0, est)},
+		// Clocks go from 03:00 back to 02:00 on 2026-10-25 in Berlin
+		{"repeated time in Berlin", "30 2 * * *", berlin, time.Date(2026, 10, 25, 0, 0, 0, 0, berlin), time.Date(2026, 10, 25, 2, 30, 0, 0, cest)},
+		{"repeated time in Berlin runs once", "30 2 * * *", berlin, time.Date(2026, 10, 25, 2, 10, 0, 0, cet), time.Date(2026, 10, 26, 2, 30, 0, 0, cet)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCron(tt.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after := tt.after.In(tt.loc)
+			if got := c.Next(after); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) of %q = %s, want %s", after, tt.expression, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/zarinit-routers/cloud-connector/config"
+	"github.com/zarinit-routers/cloud-connector/fanout"
+	"github.com/zarinit-routers/cloud-connector/jobs"
+	"github.com/zarinit-routers/cloud-connector/models"
+	"github.com/zarinit-routers/cloud-connector/storage/repository"
+)
+
+const (
+	ENV_SCHEDULER_INTERVAL = "SCHEDULER_INTERVAL"
+)
+
+var (
+	sclog = log.WithPrefix("Scheduler")
+)
+
+func getInterval() time.Duration {
+	return config.Duration(ENV_SCHEDULER_INTERVAL, 30*time.Second)
+}
+
+// NextRun returns the first run of the cron expression after the time, in
+// the time zone.
+func NextRun(expression string, timezone string, after time.Time) (time.Time, error) {
+	cron, err := ParseCron(expression)
+	if err != nil {
+		return time.Time{}, err
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time zone %q: %s", timezone, err)
+	}
+	next := cron.Next(after.In(loc))
+	if next.IsZero() {
+		return next, fmt.Errorf("cron expression %q never matches", expression)
+	}
+	return next, nil
+}
+
+// Serve runs due schedules. Runs missed while no connector was running are
+// executed once, then the schedule continues from the current time.
+func Serve() {
+	ticker := time.NewTicker(getInterval())
+	defer ticker.Stop()
+	for now := range ticker.C {
+		runDue(now)
+	}
+}
+
+func runDue(now time.Time) {
+	schedules, err := repository.GetDueSchedules(now)
+	if err != nil {
+		sclog.Error("Failed get due schedules", "error", err)
+		return
+	}
+
+	for _, schedule := range schedules {
+		var nextRunAt *time.Time
+		if next, err := NextRun(schedule.Cron, schedule.Timezone, now); err != nil {
+			sclog.Error("Bad schedule, it won't run again", "error", err, "scheduleId", schedule.ID)
+		} else {
+			nextRunAt = &next
+		}
+
+		dueAt := *schedule.NextRunAt
+		ok, err := repository.ClaimScheduleRun(schedule.ID, dueAt, nextRunAt)
+		if err != nil {
+			sclog.Error("Failed to claim schedule run", "error", err, "scheduleId", schedule.ID)
+			continue
+		}
+		if !ok {
+			// Another connector instance runs it
+			continue
+		}
+		go execute(schedule, dueAt)
+	}
+}
+
+// execute creates a job for every targeted node, jobs of offline nodes wait
+// until the nodes connect.
+func execute(schedule repository.Schedule, dueAt time.Time) {
+	nodes, err := targets(&schedule)
+	if err != nil {
+		sclog.Error("Failed select schedule nodes", "error", err, "scheduleId", schedule.ID)
+		return
+	}
+
+	for _, node := range nodes {
+		job, err := jobs.Create(&node, schedule.Command, schedule.Args.Val, schedule.TimeoutSeconds)
+		if err != nil {
+			sclog.Error("Failed create scheduled job", "error", err, "scheduleId", schedule.ID, "nodeId", node.ID)
+			continue
+		}
+		if _, err := repository.NewScheduleRun(schedule.ID, node.ID, &job.ID, dueAt); err != nil {
+			sclog.Error("Failed store schedule run", "error", err, "scheduleId", schedule.ID, "nodeId", node.ID)
+		}
+	}
+	sclog.Info("Schedule executed", "scheduleId", schedule.ID, "command", schedule.Command, "nodes", len(nodes), "dueAt", dueAt)
+}
+
+func targets(schedule *repository.Schedule) ([]repository.Node, error) {
+	if schedule.NodeID != nil {
+		node, err := repository.GetNode(*schedule.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		return []repository.Node{*node}, nil
+	}
+
+	selector := &models.Selector{
+		Tag: schedule.SelectorTag,
+	}
+	if schedule.OrganizationID != nil {
+		selector.OrganizationID = schedule.OrganizationID.String()
+	}
+	return fanout.Select(selector)
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/zarinit-routers/cloud-connector/campaigns"
+	"github.com/zarinit-routers/cloud-connector/models"
+	"github.com/zarinit-routers/cloud-connector/storage/repository"
+	"github.com/zarinit-routers/middleware/auth"
+)
+
+type CampaignRequest struct {
+	Name             string          `json:"name"`
+	Selector         models.Selector `json:"selector"`
+	WaveSizes        []int           `json:"waveSizes" binding:"required"`
+	SuccessThreshold *float64        `json:"successThreshold"`
+	PauseOnFailure   *bool           `json:"pauseOnFailure"`
+	CommandRequest
+}
+
+type ResponseCampaign struct {
+	ID               uuid.UUID      `json:"id"`
+	OrganizationID   *uuid.UUID     `json:"organizationId"`
+	Name             string         `json:"name"`
+	Command          string         `json:"command"`
+	Args             map[string]any `json:"args"`
+	TimeoutSeconds   int            `json:"timeoutSeconds"`
+	SelectorTag      string         `json:"selectorTag"`
+	WaveSizes        []int          `json:"waveSizes"`
+	SuccessThreshold float64        `json:"successThreshold"`
+	PauseOnFailure   bool           `json:"pauseOnFailure"`
+	State            string         `json:"state"`
+	CurrentWave      int            `json:"currentWave"`
+	PauseReason      string         `json:"pauseReason"`
+	CreatedAt        time.Time      `json:"createdAt"`
+	StartedAt        *time.Time     `json:"startedAt"`
+	FinishedAt       *time.Time     `json:"finishedAt"`
+	// Number of nodes in every state
+	Nodes map[string]int `json:"nodes,omitempty"`
+}
+
+func toCampaignResponse(in *repository.Campaign) ResponseCampaign {
+	return ResponseCampaign{
+		ID:               in.ID,
+		OrganizationID:   in.OrganizationID,
+		Name:             in.Name,
+		Command:          in.Command,
+		Args:             in.Args.Val,
+		TimeoutSeconds:   in.TimeoutSeconds,
+		SelectorTag:      in.SelectorTag,
+		WaveSizes:        in.WaveSizes.Val,
+		SuccessThreshold: in.SuccessThreshold,
+		PauseOnFailure:   in.PauseOnFailure,
+		State:            in.State,
+		CurrentWave:      in.CurrentWave,
+		PauseReason:      in.PauseReason,
+		CreatedAt:        in.CreatedAt,
+		StartedAt:        in.StartedAt,
+		FinishedAt:       in.FinishedAt,
+	}
+}
+
+// getCampaign reads the campaign from the ":id" uri parameter and checks the
+// user may access it, campaigns over every organization are admin only.
+func getCampaign(c *gin.Context) (*repository.Campaign, bool) {
+	user, err := auth.GetUser(c)
+	if err != nil {
+		log.Error("Failed get user", "error", err)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return nil, false
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		log.Error("Failed parse id", "error", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return nil, false
+	}
+
+	campaign, err := repository.GetCampaign(id)
+	if err != nil {
+		log.Error("Failed get campaign from repository", "error", err, "campaignId", id)
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+	}
+
+	if !user.IsAdmin() && (campaign.OrganizationID == nil || *campaign.OrganizationID != user.OrganizationID) {
+		log.Error("Try to access to campaign outside of own organization", "campaign.OrganizationID", campaign.OrganizationID, "user.OrganizationID", user.OrganizationID)
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+	}
+	return campaign, true
+}
+
+func CreateCampaignHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user *auth.AuthData
+		if u, err := auth.GetUser(c); err != nil {
+			log.Error("Failed get user", "error", err)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		} else {
+			user = u
+		}
+
+		var request CampaignRequest
+		if err := c.BindJSON(&request); err != nil {
+			log.Error("Failed bind json", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if request.TimeoutSeconds < 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "negative timeout specified"})
+			return
+		}
+		if !scopeSelector(c, user, &request.Selector) {
+			return
+		}
+		threshold := 1.0
+		if request.SuccessThreshold != nil {
+			threshold = *request.SuccessThreshold
+		}
+		pauseOnFailure := true
+		if request.PauseOnFailure != nil {
+			pauseOnFailure = *request.PauseOnFailure
+		}
+
+		campaign, err := campaigns.Create(&request.Selector, request.Name, request.Command, request.Args, request.TimeoutSeconds, request.WaveSizes, threshold, pauseOnFailure)
+		if errors.Is(err, campaigns.ErrNoNodes) || errors.Is(err, campaigns.ErrBadWaves) || errors.Is(err, campaigns.ErrBadThreshold) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Error("Failed create campaign", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"campaign": toCampaignResponse(campaign),
+		})
+	}
+}
+
+// GetCampaignHandler returns the campaign with the number of nodes in every
+// state.
+func GetCampaignHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		campaign, ok := getCampaign(c)
+		if !ok {
+			return
+		}
+
+		counts, err := repository.CountCampaignNodes(campaign.ID)
+		if err != nil {
+			log.Error("Failed count campaign nodes", "error", err, "campaignId", campaign.ID)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		response := toCampaignResponse(campaign)
+		response.Nodes = counts
+		c.JSON(http.StatusOK, gin.H{
+			"campaign": response,
+		})
+	}
+}
+
+func GetCampaignNodesHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		campaign, ok := getCampaign(c)
+		if !ok {
+			return
+		}
+
+		var query struct {
+			State  string `form:"state"`
+			Limit  int    `form:"limit"`
+			Offset int    `form:"offset"`
+		}
+		if err := c.BindQuery(&query); err != nil {
+			log.Error("Failed bind query", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if query.Limit <= 0 || query.Limit > 500 {
+			query.Limit = 100
+		}
+
+		nodes, err := repository.GetCampaignNodes(campaign.ID, query.State, query.Limit, max(query.Offset, 0))
+		if err != nil {
+			log.Error("Failed get campaign nodes from repository", "error", err, "campaignId", campaign.ID)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"nodes": nodes,
+		})
+	}
+}
+
+func StartCampaignHandler() gin.HandlerFunc {
+	return campaignActionHandler(campaigns.Start)
+}
+
+// PauseCampaignHandler stops the campaign after the current wave.
+func PauseCampaignHandler() gin.HandlerFunc {
+	return campaignActionHandler(campaigns.Pause)
+}
+
+func ResumeCampaignHandler() gin.HandlerFunc {
+	return campaignActionHandler(campaigns.Resume)
+}
+
+func AbortCampaignHandler() gin.HandlerFunc {
+	return campaignActionHandler(campaigns.Abort)
+}
+
+func campaignActionHandler(action func(id uuid.UUID) error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		campaign, ok := getCampaign(c)
+		if !ok {
+			return
+		}
+
+		err := action(campaign.ID)
+		if errors.Is(err, campaigns.ErrBadState) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error(), "state": campaign.State})
+			return
+		}
+		if err != nil {
+			log.Error("Failed change campaign state", "error", err, "campaignId", campaign.ID)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if current, err := repository.GetCampaign(campaign.ID); err == nil {
+			campaign = current
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"campaign": toCampaignResponse(campaign),
+		})
+	}
+}
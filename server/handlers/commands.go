@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+	"github.com/zarinit-routers/cloud-connector/config"
+	"github.com/zarinit-routers/cloud-connector/connections"
+	"github.com/zarinit-routers/cloud-connector/dispatch"
+	"github.com/zarinit-routers/cloud-connector/models"
+	"github.com/zarinit-routers/cloud-connector/tracker"
+)
+
+const (
+	ENV_SYNC_COMMAND_MAX_TIMEOUT = "SYNC_COMMAND_MAX_TIMEOUT"
+)
+
+func getSyncCommandMaxTimeout() time.Duration {
+	return config.Duration(ENV_SYNC_COMMAND_MAX_TIMEOUT, 5*time.Minute)
+}
+
+type CommandRequest struct {
+	Command        string         `json:"command" binding:"required"`
+	Args           models.JsonMap `json:"args"`
+	TimeoutSeconds int            `json:"timeoutSeconds"`
+}
+
+// sendErrorStatus maps errors of sending a request to HTTP statuses.
+func sendErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, connections.ErrNotConnected), errors.Is(err, connections.ErrSessionClosed):
+		return http.StatusConflict
+	case errors.Is(err, connections.ErrUnsupportedCommand):
+		return http.StatusBadRequest
+	case errors.Is(err, connections.ErrOutboundFull):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// RunCommandHandler sends a command to the node and answers with its
+// response, the request stays open until the node answers or the timeout
+// passes.
+func RunCommandHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, node, ok := getUserNode(c)
+		if !ok {
+			return
+		}
+
+		var request CommandRequest
+		if err := c.BindJSON(&request); err != nil {
+			log.Error("Failed bind json", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if request.TimeoutSeconds < 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "negative timeout specified"})
+			return
+		}
+
+		timeout := tracker.Timeout(request.Command, time.Duration(request.TimeoutSeconds)*time.Second)
+		timeout = min(timeout, getSyncCommandMaxTimeout())
+
+		response, err := dispatch.Call(c.Request.Context(), node.ID, request.Command, request.Args, timeout)
+		if err != nil {
+			log.Error("Failed run command", "error", err, "nodeId", node.ID, "command", request.Command)
+			c.AbortWithStatusJSON(sendErrorStatus(err), gin.H{"requestError": err.Error()})
+			return
+		}
+
+		status := http.StatusOK
+		switch response.RequestError {
+		case "":
+		case tracker.RequestErrorTimeout:
+			status = http.StatusGatewayTimeout
+		default:
+			status = http.StatusBadGateway
+		}
+		c.JSON(status, response)
+	}
+}
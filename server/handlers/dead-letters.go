@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/zarinit-routers/cloud-connector/queue"
+	"github.com/zarinit-routers/cloud-connector/storage/repository"
+	"github.com/zarinit-routers/middleware/auth"
+)
+
+type ResponseDeadLetter struct {
+	ID            uuid.UUID  `json:"id"`
+	CorrelationID string     `json:"correlationId"`
+	ReplyTo       string     `json:"replyTo"`
+	Reason        string     `json:"reason"`
+	Error         string     `json:"error"`
+	Body          string     `json:"body"`
+	ContentType   string     `json:"contentType"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	ReplayedAt    *time.Time `json:"replayedAt"`
+}
+
+func toDeadLetterResponse(in *repository.DeadLetter) ResponseDeadLetter {
+	return ResponseDeadLetter{
+		ID:            in.ID,
+		CorrelationID: in.CorrelationID,
+		ReplyTo:       in.ReplyTo,
+		Reason:        in.Reason,
+		Error:         in.Error,
+		Body:          string(in.Body),
+		ContentType:   in.ContentType,
+		CreatedAt:     in.CreatedAt,
+		ReplayedAt:    in.ReplayedAt,
+	}
+}
+
+func getAdmin(c *gin.Context) (*auth.AuthData, bool) {
+	user, err := auth.GetUser(c)
+	if err != nil {
+		log.Error("Failed get user", "error", err)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return nil, false
+	}
+	if !user.IsAdmin() {
+		log.Error("Try to access admin endpoint without admin rights", "user", user)
+		c.AbortWithStatus(http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+func getDeadLetter(c *gin.Context) (*repository.DeadLetter, bool) {
+	var uri struct {
+		Id string `uri:"id" binding:"required"`
+	}
+	if err := c.BindUri(&uri); err != nil {
+		log.Error("Failed bind uri", "error", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return nil, false
+	}
+	id, err := uuid.Parse(uri.Id)
+	if err != nil {
+		log.Error("Failed parse id", "error", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return nil, false
+	}
+	letter, err := repository.GetDeadLetter(id)
+	if err != nil {
+		log.Error("Failed get dead letter from repository", "error", err, "id", id)
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+	}
+	return letter, true
+}
+
+func GetDeadLettersHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := getAdmin(c); !ok {
+			return
+		}
+
+		var query struct {
+			Limit  int `form:"limit"`
+			Offset int `form:"offset"`
+		}
+		if err := c.BindQuery(&query); err != nil {
+			log.Error("Failed bind query", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if query.Limit <= 0 || query.Limit > 500 {
+			query.Limit = 100
+		}
+
+		letters, err := repository.GetDeadLetters(query.Limit, max(query.Offset, 0))
+		if err != nil {
+			log.Error("Failed get dead letters from repository", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		out := []ResponseDeadLetter{}
+		for _, letter := range letters {
+			out = append(out, toDeadLetterResponse(&letter))
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"deadLetters": out,
+		})
+	}
+}
+
+func GetDeadLetterHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := getAdmin(c); !ok {
+			return
+		}
+
+		letter, ok := getDeadLetter(c)
+		if !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"deadLetter": toDeadLetterResponse(letter),
+		})
+	}
+}
+
+// ReplayDeadLetterHandler publishes a dead-lettered request to the requests
+// queue again, the body may be replaced with a corrected one.
+func ReplayDeadLetterHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := getAdmin(c)
+		if !ok {
+			return
+		}
+
+		letter, ok := getDeadLetter(c)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			Body          json.RawMessage `json:"body"`
+			CorrelationID string          `json:"correlationId"`
+		}
+		if c.Request.ContentLength > 0 {
+			if err := c.BindJSON(&request); err != nil {
+				log.Error("Failed bind json", "error", err)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+		}
+
+		body := letter.Body
+		contentType := letter.ContentType
+		if len(request.Body) > 0 {
+			body = request.Body
+			contentType = "application/json"
+		}
+		route := queue.Route{
+			RequestID: letter.CorrelationID,
+			ReplyTo:   letter.ReplyTo,
+		}
+		if request.CorrelationID != "" {
+			route.RequestID = request.CorrelationID
+		}
+
+		if err := queue.Replay(route, contentType, body); err != nil {
+			log.Error("Failed replay dead letter", "error", err, "id", letter.ID)
+			c.AbortWithStatus(http.StatusServiceUnavailable)
+			return
+		}
+		if err := repository.MarkDeadLetterReplayed(letter.ID); err != nil {
+			log.Error("Failed mark dead letter replayed", "error", err, "id", letter.ID)
+		}
+		log.Info("Dead letter replayed", "id", letter.ID, "correlationId", route.RequestID, "user", user)
+
+		c.Status(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+	"github.com/zarinit-routers/cloud-connector/fanout"
+	"github.com/zarinit-routers/cloud-connector/models"
+	"github.com/zarinit-routers/cloud-connector/tracker"
+	"github.com/zarinit-routers/middleware/auth"
+)
+
+type FanoutRequest struct {
+	Selector models.Selector `json:"selector"`
+	CommandRequest
+}
+
+// scopeSelector limits the selector to the organization of the user, only
+// admins may select nodes of other organizations.
+func scopeSelector(c *gin.Context, user *auth.AuthData, selector *models.Selector) bool {
+	if !user.IsAdmin() {
+		if selector.OrganizationID == "" {
+			selector.OrganizationID = user.OrganizationID.String()
+		}
+		organizationID, err := selector.ParseOrganizationID()
+		if err == nil && *organizationID != user.OrganizationID {
+			log.Error("Try to select nodes outside of own organization", "selector.OrganizationID", selector.OrganizationID, "user.OrganizationID", user.OrganizationID)
+			c.AbortWithStatus(http.StatusForbidden)
+			return false
+		}
+	}
+	if err := selector.Validate(); err != nil {
+		log.Error("Bad selector", "error", err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// FanoutCommandHandler runs a command on every selected node and answers with
+// the results of all of them.
+func FanoutCommandHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user *auth.AuthData
+		if u, err := auth.GetUser(c); err != nil {
+			log.Error("Failed get user", "error", err)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		} else {
+			user = u
+		}
+
+		var request FanoutRequest
+		if err := c.BindJSON(&request); err != nil {
+			log.Error("Failed bind json", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if request.TimeoutSeconds < 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "negative timeout specified"})
+			return
+		}
+		if !scopeSelector(c, user, &request.Selector) {
+			return
+		}
+
+		nodes, err := fanout.Select(&request.Selector)
+		if err != nil {
+			log.Error("Failed select nodes", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		timeout := tracker.Timeout(request.Command, time.Duration(request.TimeoutSeconds)*time.Second)
+		timeout = min(timeout, getSyncCommandMaxTimeout())
+
+		c.JSON(http.StatusOK, fanout.Call(nodes, request.Command, request.Args, timeout))
+	}
+}
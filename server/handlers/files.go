@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/zarinit-routers/cloud-connector/config"
+	"github.com/zarinit-routers/cloud-connector/connections"
+	"github.com/zarinit-routers/cloud-connector/storage/repository"
+	"github.com/zarinit-routers/cloud-connector/transfer"
+	"github.com/zarinit-routers/middleware/auth"
+)
+
+const (
+	ENV_FILE_MAX_UPLOAD_SIZE = "FILE_MAX_UPLOAD_SIZE"
+)
+
+func getMaxUploadSize() int64 {
+	return int64(config.Int(ENV_FILE_MAX_UPLOAD_SIZE, 512*1024*1024))
+}
+
+type ResponseFileTransfer struct {
+	ID        uuid.UUID `json:"id"`
+	NodeID    uuid.UUID `json:"nodeId"`
+	Name      string    `json:"name"`
+	Target    string    `json:"target"`
+	Sha256    string    `json:"sha256"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	State     string    `json:"state"`
+	Error     string    `json:"error"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func toFileTransferResponse(in *repository.FileTransfer) ResponseFileTransfer {
+	return ResponseFileTransfer{
+		ID:        in.ID,
+		NodeID:    in.NodeID,
+		Name:      in.Name,
+		Target:    in.Target,
+		Sha256:    in.Sha256,
+		Size:      in.Size,
+		Offset:    in.Offset,
+		State:     in.State,
+		Error:     in.Error,
+		CreatedAt: in.CreatedAt,
+		UpdatedAt: in.UpdatedAt,
+	}
+}
+
+// getUserNode reads the node from the ":id" uri parameter and checks the
+// user may access it.
+func getUserNode(c *gin.Context) (*auth.AuthData, *repository.Node, bool) {
+	user, err := auth.GetUser(c)
+	if err != nil {
+		log.Error("Failed get user", "error", err)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return nil, nil, false
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		log.Error("Failed parse id", "error", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	node, err := repository.GetNode(id)
+	if err != nil {
+		log.Error("Failed get node from repository", "error", err, "nodeId", id)
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	if node.OrganizationID != user.OrganizationID && !user.IsAdmin() {
+		log.Error("Try to access to node outside of own organization", "node.OrganizationID", node.OrganizationID, "user.OrganizationID", user.OrganizationID)
+		c.AbortWithStatus(http.StatusForbidden)
+		return nil, nil, false
+	}
+	return user, node, true
+}
+
+// UploadFileHandler takes a multipart "file" or, for admins, a "path" inside
+// the blob store and sends it to the node, right away or when the node
+// connects.
+func UploadFileHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, node, ok := getUserNode(c)
+		if !ok {
+			return
+		}
+
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, getMaxUploadSize())
+		var form struct {
+			Path   string `form:"path"`
+			Name   string `form:"name"`
+			Target string `form:"target"`
+		}
+		if err := c.ShouldBind(&form); err != nil {
+			log.Error("Failed bind form", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		var sha string
+		var size int64
+		if header, err := c.FormFile("file"); err == nil {
+			file, err := header.Open()
+			if err != nil {
+				log.Error("Failed open uploaded file", "error", err)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			if sha, size, err = transfer.StoreBlob(file); err != nil {
+				log.Error("Failed store uploaded file", "error", err)
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			if form.Name == "" {
+				form.Name = header.Filename
+			}
+		} else if form.Path != "" {
+			// The blob store is shared by every organization
+			if !user.IsAdmin() {
+				log.Error("Try to send file from blob store without admin rights", "user", user)
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "only admins may send files from the blob store"})
+				return
+			}
+			if sha, size, err = transfer.StoreLocalFile(form.Path); err != nil {
+				log.Error("Failed store file from blob store", "error", err, "path", form.Path)
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if form.Name == "" {
+				form.Name = filepath.Base(form.Path)
+			}
+		} else {
+			log.Error("Neither file nor path specified")
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		record, err := repository.NewFileTransfer(node.ID, form.Name, form.Target, sha, size)
+		if err != nil {
+			log.Error("Failed create file transfer", "error", err, "nodeId", node.ID)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		// Otherwise the transfer stays pending until the node connects and
+		// transfer.Resume picks it up
+		if session, ok := connections.GetSession(node.ID); ok {
+			go func() {
+				select {
+				case <-session.Ready():
+				case <-session.Done():
+					return
+				}
+				err := transfer.Start(session, record)
+				if errors.Is(err, transfer.ErrUnsupported) {
+					log.Warn("Node doesn't support file transfers, leaving transfer pending", "transferId", record.ID, "nodeId", node.ID)
+					return
+				}
+				if err != nil {
+					log.Error("Failed start file transfer", "error", err, "transferId", record.ID)
+				}
+			}()
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"transfer": toFileTransferResponse(record),
+		})
+	}
+}
+
+func GetFileTransferHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, node, ok := getUserNode(c)
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(c.Param("transferId"))
+		if err != nil {
+			log.Error("Failed parse transfer id", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		record, err := repository.GetFileTransfer(id)
+		if err != nil || record.NodeID != node.ID {
+			log.Error("Failed get file transfer from repository", "error", err, "transferId", id)
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"transfer": toFileTransferResponse(record),
+		})
+	}
+}
@@ -20,10 +20,21 @@ type ResponseNode struct {
 	Tags            []*repository.Tag `json:"tags"`
 	OrganizationID  uuid.UUID         `json:"organizationId"`
 	Connected       bool              `json:"connected"`
+	ProtocolVersion int               `json:"protocolVersion"`
+	FirmwareVersion string            `json:"firmwareVersion"`
+	Model           string            `json:"model"`
+	Commands        []string          `json:"commands"`
+	// Traffic of the current session, only for connected nodes
+	Traffic *connections.SessionStats `json:"traffic,omitempty"`
 }
 
 func toResponse(in *repository.Node) ResponseNode {
-	connected := connections.IsConnected(in.ID)
+	session, connected := connections.GetSession(in.ID)
+	var traffic *connections.SessionStats
+	if connected {
+		stats := session.Stats()
+		traffic = &stats
+	}
 	return ResponseNode{
 		ID:              in.ID,
 		Name:            in.Name,
@@ -32,6 +43,11 @@ func toResponse(in *repository.Node) ResponseNode {
 		Tags:            in.Tags,
 		OrganizationID:  in.OrganizationID,
 		Connected:       connected,
+		ProtocolVersion: in.ProtocolVersion,
+		FirmwareVersion: in.FirmwareVersion,
+		Model:           in.Model,
+		Commands:        in.Commands.Val,
+		Traffic:         traffic,
 	}
 }
 
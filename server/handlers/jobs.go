@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/zarinit-routers/cloud-connector/jobs"
+	"github.com/zarinit-routers/cloud-connector/storage/repository"
+	"github.com/zarinit-routers/middleware/auth"
+)
+
+type ResponseJob struct {
+	ID             uuid.UUID      `json:"id"`
+	NodeID         uuid.UUID      `json:"nodeId"`
+	Command        string         `json:"command"`
+	Args           map[string]any `json:"args"`
+	TimeoutSeconds int            `json:"timeoutSeconds"`
+	State          string         `json:"state"`
+	Progress       map[string]any `json:"progress"`
+	Data           map[string]any `json:"data"`
+	RequestError   string         `json:"requestError"`
+	CommandError   string         `json:"commandError"`
+	CreatedAt      time.Time      `json:"createdAt"`
+	SentAt         *time.Time     `json:"sentAt"`
+	StartedAt      *time.Time     `json:"startedAt"`
+	FinishedAt     *time.Time     `json:"finishedAt"`
+}
+
+func toJobResponse(in *repository.Job) ResponseJob {
+	return ResponseJob{
+		ID:             in.ID,
+		NodeID:         in.NodeID,
+		Command:        in.Command,
+		Args:           in.Args.Val,
+		TimeoutSeconds: in.TimeoutSeconds,
+		State:          in.State,
+		Progress:       in.Progress.Val,
+		Data:           in.Data.Val,
+		RequestError:   in.RequestError,
+		CommandError:   in.CommandError,
+		CreatedAt:      in.CreatedAt,
+		SentAt:         in.SentAt,
+		StartedAt:      in.StartedAt,
+		FinishedAt:     in.FinishedAt,
+	}
+}
+
+// CreateJobHandler queues a command for the node and answers right away, the
+// job state is polled with GetJobHandler.
+func CreateJobHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, node, ok := getUserNode(c)
+		if !ok {
+			return
+		}
+
+		var request CommandRequest
+		if err := c.BindJSON(&request); err != nil {
+			log.Error("Failed bind json", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if request.TimeoutSeconds < 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "negative timeout specified"})
+			return
+		}
+
+		job, err := jobs.Create(node, request.Command, request.Args, request.TimeoutSeconds)
+		if err != nil {
+			log.Error("Failed create job", "error", err, "nodeId", node.ID)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if current, err := repository.GetJob(job.ID); err == nil {
+			job = current
+		}
+		c.JSON(http.StatusAccepted, gin.H{
+			"job": toJobResponse(job),
+		})
+	}
+}
+
+func GetJobHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user *auth.AuthData
+		if u, err := auth.GetUser(c); err != nil {
+			log.Error("Failed get user", "error", err)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		} else {
+			user = u
+		}
+
+		id, err := uuid.Parse(c.Param("jobId"))
+		if err != nil {
+			log.Error("Failed parse job id", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		job, err := repository.GetJob(id)
+		if err != nil {
+			log.Error("Failed get job from repository", "error", err, "jobId", id)
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		if job.OrganizationID != user.OrganizationID && !user.IsAdmin() {
+			log.Error("Try to access to job outside of own organization", "job.OrganizationID", job.OrganizationID, "user.OrganizationID", user.OrganizationID)
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"job": toJobResponse(job),
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/zarinit-routers/cloud-connector/models"
+	"github.com/zarinit-routers/cloud-connector/scheduler"
+	"github.com/zarinit-routers/cloud-connector/storage/repository"
+	"github.com/zarinit-routers/middleware/auth"
+)
+
+type ScheduleRequest struct {
+	Name     string `json:"name"`
+	Cron     string `json:"cron" binding:"required"`
+	Timezone string `json:"timezone"`
+	// Either the node or the selector is set
+	NodeID   string           `json:"nodeId"`
+	Selector *models.Selector `json:"selector"`
+	CommandRequest
+}
+
+type ResponseSchedule struct {
+	ID             uuid.UUID      `json:"id"`
+	OrganizationID *uuid.UUID     `json:"organizationId"`
+	Name           string         `json:"name"`
+	Cron           string         `json:"cron"`
+	Timezone       string         `json:"timezone"`
+	Command        string         `json:"command"`
+	Args           map[string]any `json:"args"`
+	TimeoutSeconds int            `json:"timeoutSeconds"`
+	NodeID         *uuid.UUID     `json:"nodeId"`
+	SelectorTag    string         `json:"selectorTag"`
+	Enabled        bool           `json:"enabled"`
+	NextRunAt      *time.Time     `json:"nextRunAt"`
+	LastRunAt      *time.Time     `json:"lastRunAt"`
+	CreatedAt      time.Time      `json:"createdAt"`
+}
+
+type ResponseScheduleRun struct {
+	ID          uuid.UUID    `json:"id"`
+	NodeID      uuid.UUID    `json:"nodeId"`
+	ScheduledAt time.Time    `json:"scheduledAt"`
+	Job         *ResponseJob `json:"job"`
+}
+
+func toScheduleResponse(in *repository.Schedule) ResponseSchedule {
+	return ResponseSchedule{
+		ID:             in.ID,
+		OrganizationID: in.OrganizationID,
+		Name:           in.Name,
+		Cron:           in.Cron,
+		Timezone:       in.Timezone,
+		Command:        in.Command,
+		Args:           in.Args.Val,
+		TimeoutSeconds: in.TimeoutSeconds,
+		NodeID:         in.NodeID,
+		SelectorTag:    in.SelectorTag,
+		Enabled:        in.Enabled,
+		NextRunAt:      in.NextRunAt,
+		LastRunAt:      in.LastRunAt,
+		CreatedAt:      in.CreatedAt,
+	}
+}
+
+func toScheduleRunResponse(in *repository.ScheduleRun) ResponseScheduleRun {
+	out := ResponseScheduleRun{
+		ID:          in.ID,
+		NodeID:      in.NodeID,
+		ScheduledAt: in.ScheduledAt,
+	}
+	if in.Job != nil {
+		job := toJobResponse(in.Job)
+		out.Job = &job
+	}
+	return out
+}
+
+// getSchedule reads the schedule from the ":id" uri parameter and checks the
+// user may access it.
+func getSchedule(c *gin.Context) (*repository.Schedule, bool) {
+	user, err := auth.GetUser(c)
+	if err != nil {
+		log.Error("Failed get user", "error", err)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return nil, false
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		log.Error("Failed parse id", "error", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return nil, false
+	}
+
+	schedule, err := repository.GetSchedule(id)
+	if err != nil {
+		log.Error("Failed get schedule from repository", "error", err, "scheduleId", id)
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+	}
+
+	if !user.IsAdmin() && (schedule.OrganizationID == nil || *schedule.OrganizationID != user.OrganizationID) {
+		log.Error("Try to access to schedule outside of own organization", "schedule.OrganizationID", schedule.OrganizationID, "user.OrganizationID", user.OrganizationID)
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+	}
+	return schedule, true
+}
+
+func CreateScheduleHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user *auth.AuthData
+		if u, err := auth.GetUser(c); err != nil {
+			log.Error("Failed get user", "error", err)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		} else {
+			user = u
+		}
+
+		var request ScheduleRequest
+		if err := c.BindJSON(&request); err != nil {
+			log.Error("Failed bind json", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if request.TimeoutSeconds < 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "negative timeout specified"})
+			return
+		}
+		if (request.NodeID == "") == (request.Selector == nil) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "either node id or selector must be specified"})
+			return
+		}
+		if request.Timezone == "" {
+			request.Timezone = "UTC"
+		}
+
+		nextRunAt, err := scheduler.NextRun(request.Cron, request.Timezone, time.Now())
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var organizationID, nodeID *uuid.UUID
+		var tag string
+		if request.NodeID != "" {
+			id, err := uuid.Parse(request.NodeID)
+			if err != nil {
+				log.Error("Failed parse node id", "error", err)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			node, err := repository.GetNode(id)
+			if err != nil {
+				log.Error("Failed get node from repository", "error", err, "nodeId", id)
+				c.AbortWithStatus(http.StatusNotFound)
+				return
+			}
+			if node.OrganizationID != user.OrganizationID && !user.IsAdmin() {
+				log.Error("Try to access to node outside of own organization", "node.OrganizationID", node.OrganizationID, "user.OrganizationID", user.OrganizationID)
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			nodeID, organizationID = &node.ID, &node.OrganizationID
+		} else {
+			if !scopeSelector(c, user, request.Selector) {
+				return
+			}
+			organizationID, _ = request.Selector.ParseOrganizationID()
+			tag = request.Selector.Tag
+		}
+
+		schedule, err := repository.NewSchedule(organizationID, request.Name, request.Cron, request.Timezone, request.Command, request.Args, request.TimeoutSeconds, nodeID, tag, nextRunAt)
+		if err != nil {
+			log.Error("Failed create schedule", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"schedule": toScheduleResponse(schedule),
+		})
+	}
+}
+
+func GetSchedulesHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user *auth.AuthData
+		if u, err := auth.GetUser(c); err != nil {
+			log.Error("Failed get user", "error", err)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		} else {
+			user = u
+		}
+
+		schedules, err := repository.GetSchedules(&user.OrganizationID)
+		if err != nil {
+			log.Error("Failed get schedules from repository", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		out := []ResponseSchedule{}
+		for _, schedule := range schedules {
+			out = append(out, toScheduleResponse(&schedule))
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"schedules": out,
+		})
+	}
+}
+
+func GetScheduleHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		schedule, ok := getSchedule(c)
+		if !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"schedule": toScheduleResponse(schedule),
+		})
+	}
+}
+
+// SetScheduleEnabledHandler enables or disables the schedule, an enabled
+// schedule runs next at the first matching time from now.
+func SetScheduleEnabledHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		schedule, ok := getSchedule(c)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			Enabled *bool `json:"enabled" binding:"required"`
+		}
+		if err := c.BindJSON(&request); err != nil {
+			log.Error("Failed bind json", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		var nextRunAt *time.Time
+		if *request.Enabled {
+			next, err := scheduler.NextRun(schedule.Cron, schedule.Timezone, time.Now())
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			nextRunAt = &next
+		}
+		if err := repository.UpdateScheduleEnabled(schedule.ID, *request.Enabled, nextRunAt); err != nil {
+			log.Error("Failed update schedule", "error", err, "scheduleId", schedule.ID)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		schedule.Enabled, schedule.NextRunAt = *request.Enabled, nextRunAt
+		c.JSON(http.StatusOK, gin.H{
+			"schedule": toScheduleResponse(schedule),
+		})
+	}
+}
+
+func DeleteScheduleHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		schedule, ok := getSchedule(c)
+		if !ok {
+			return
+		}
+
+		if err := repository.RemoveSchedule(schedule.ID); err != nil {
+			log.Error("Failed remove schedule", "error", err, "scheduleId", schedule.ID)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+func GetScheduleRunsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		schedule, ok := getSchedule(c)
+		if !ok {
+			return
+		}
+
+		var query struct {
+			Limit  int `form:"limit"`
+			Offset int `form:"offset"`
+		}
+		if err := c.BindQuery(&query); err != nil {
+			log.Error("Failed bind query", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if query.Limit <= 0 || query.Limit > 500 {
+			query.Limit = 100
+		}
+
+		runs, err := repository.GetScheduleRuns(schedule.ID, query.Limit, max(query.Offset, 0))
+		if err != nil {
+			log.Error("Failed get schedule runs from repository", "error", err, "scheduleId", schedule.ID)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		out := []ResponseScheduleRun{}
+		for _, run := range runs {
+			out = append(out, toScheduleRunResponse(&run))
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"runs": out,
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/zarinit-routers/cloud-connector/config"
+	"github.com/zarinit-routers/cloud-connector/connections"
+	"github.com/zarinit-routers/cloud-connector/models"
+	"github.com/zarinit-routers/cloud-connector/storage/repository"
+	"github.com/zarinit-routers/cloud-connector/tunnel"
+)
+
+const (
+	ENV_TUNNEL_ALLOWED_ORIGINS = "TUNNEL_ALLOWED_ORIGINS"
+	ENV_TUNNEL_ALLOWED_HOSTS   = "TUNNEL_ALLOWED_HOSTS"
+)
+
+var tunnelUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     checkTunnelOrigin,
+}
+
+// checkTunnelOrigin allows the same origin and origins listed in
+// TUNNEL_ALLOWED_ORIGINS separated by commas.
+func checkTunnelOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || strings.EqualFold(strings.TrimPrefix(strings.TrimPrefix(origin, "https://"), "http://"), r.Host) {
+		return true
+	}
+	allowed := strings.Split(config.String(ENV_TUNNEL_ALLOWED_ORIGINS, ""), ",")
+	return slices.ContainsFunc(allowed, func(o string) bool {
+		return strings.EqualFold(strings.TrimSpace(o), origin)
+	})
+}
+
+// checkTunnelHost allows admins any host on the node network, other users
+// only the node itself and hosts listed in TUNNEL_ALLOWED_HOSTS separated by
+// commas.
+func checkTunnelHost(host string, admin bool) bool {
+	if admin || host == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	allowed := strings.Split(config.String(ENV_TUNNEL_ALLOWED_HOSTS, ""), ",")
+	return slices.ContainsFunc(allowed, func(h string) bool {
+		return strings.EqualFold(strings.TrimSpace(h), host)
+	})
+}
+
+type ResponseTunnelSession struct {
+	ID             uuid.UUID  `json:"id"`
+	NodeID         uuid.UUID  `json:"nodeId"`
+	OrganizationID uuid.UUID  `json:"organizationId"`
+	UserID         uuid.UUID  `json:"userId"`
+	Kind           string     `json:"kind"`
+	Target         string     `json:"target"`
+	ClientAddress  string     `json:"clientAddress"`
+	UserAgent      string     `json:"userAgent"`
+	OpenedAt       time.Time  `json:"openedAt"`
+	ClosedAt       *time.Time `json:"closedAt"`
+	BytesToNode    int64      `json:"bytesToNode"`
+	BytesFromNode  int64      `json:"bytesFromNode"`
+	CloseReason    string     `json:"closeReason"`
+}
+
+func toTunnelSessionResponse(in *repository.TunnelSession) ResponseTunnelSession {
+	return ResponseTunnelSession{
+		ID:             in.ID,
+		NodeID:         in.NodeID,
+		OrganizationID: in.OrganizationID,
+		UserID:         in.UserID,
+		Kind:           in.Kind,
+		Target:         in.Target,
+		ClientAddress:  in.ClientAddress,
+		UserAgent:      in.UserAgent,
+		OpenedAt:       in.OpenedAt,
+		ClosedAt:       in.ClosedAt,
+		BytesToNode:    in.BytesToNode,
+		BytesFromNode:  in.BytesFromNode,
+		CloseReason:    in.CloseReason,
+	}
+}
+
+// TunnelHandler upgrades the request to a websocket relayed to a shell or a
+// TCP port on the node.
+func TunnelHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, node, ok := getUserNode(c)
+		if !ok {
+			return
+		}
+
+		var query struct {
+			Kind string `form:"kind"`
+			Host string `form:"host"`
+			Port int    `form:"port"`
+		}
+		if err := c.BindQuery(&query); err != nil {
+			log.Error("Failed bind query", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if query.Kind == "" {
+			query.Kind = models.TunnelKindShell
+		}
+		if query.Host == "" {
+			query.Host = "127.0.0.1"
+		}
+		if err := models.ValidateTunnelTarget(query.Kind, query.Port); err != nil {
+			log.Error("Bad tunnel target", "error", err)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !checkTunnelHost(query.Host, user.IsAdmin()) {
+			log.Error("Tunnel to not allowed host", "host", query.Host, "nodeId", node.ID)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "tunnel host not allowed"})
+			return
+		}
+
+		session, ok := connections.GetSession(node.ID)
+		if !ok {
+			log.Error("Tunnel to node that is not connected", "nodeId", node.ID)
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "node is not connected"})
+			return
+		}
+		select {
+		case <-session.Ready():
+		case <-session.Done():
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "node is not connected"})
+			return
+		}
+		if !session.Supports(models.CommandTunnel) {
+			log.Error("Tunnel to node without tunnel support", "nodeId", node.ID)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "tunnels are not supported by node"})
+			return
+		}
+
+		conn, err := tunnelUpgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			log.Error("Failed to upgrade connection", "error", err)
+			return
+		}
+
+		tunnel.Serve(session, conn, tunnel.Options{
+			Kind:           query.Kind,
+			Host:           query.Host,
+			Port:           query.Port,
+			OrganizationID: user.OrganizationID,
+			UserID:         user.ID,
+			ClientAddress:  c.ClientIP(),
+			UserAgent:      c.Request.UserAgent(),
+		})
+	}
+}
+
+func GetTunnelSessionsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, node, ok := getUserNode(c)
+		if !ok {
+			return
+		}
+
+		var query struct {
+			Limit  int `form:"limit"`
+			Offset int `form:"offset"`
+		}
+		if err := c.BindQuery(&query); err != nil {
+			log.Error("Failed bind query", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if query.Limit <= 0 || query.Limit > 500 {
+			query.Limit = 100
+		}
+
+		sessions, err := repository.GetTunnelSessions(node.ID, query.Limit, max(query.Offset, 0))
+		if err != nil {
+			log.Error("Failed get tunnel sessions from repository", "error", err, "nodeId", node.ID)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		out := []ResponseTunnelSession{}
+		for _, session := range sessions {
+			out = append(out, toTunnelSessionResponse(&session))
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"tunnels": out,
+		})
+	}
+}
@@ -49,5 +49,39 @@ func Serve() error {
 	api.GET("/:id", auth.Middleware(), handlers.GetSingleClientHandler())
 	api.POST("/tags/add", auth.Middleware(), handlers.AddTagsHandler())
 	api.POST("/tags/remove", auth.Middleware(), handlers.RemoveTagsHandler())
+	api.POST("/:id/files", auth.Middleware(), handlers.UploadFileHandler())
+	api.GET("/:id/files/:transferId", auth.Middleware(), handlers.GetFileTransferHandler())
+	api.GET("/:id/tunnel", auth.Middleware(), handlers.TunnelHandler())
+	api.GET("/:id/tunnels", auth.Middleware(), handlers.GetTunnelSessionsHandler())
+	api.POST("/:id/commands", auth.Middleware(), handlers.RunCommandHandler())
+	api.POST("/:id/jobs", auth.Middleware(), handlers.CreateJobHandler())
+
+	commands := srv.Group("/api/commands")
+	commands.POST("/", auth.Middleware(), handlers.FanoutCommandHandler())
+
+	campaignsApi := srv.Group("/api/campaigns")
+	campaignsApi.POST("/", auth.Middleware(), handlers.CreateCampaignHandler())
+	campaignsApi.GET("/:id", auth.Middleware(), handlers.GetCampaignHandler())
+	campaignsApi.GET("/:id/nodes", auth.Middleware(), handlers.GetCampaignNodesHandler())
+	campaignsApi.POST("/:id/start", auth.Middleware(), handlers.StartCampaignHandler())
+	campaignsApi.POST("/:id/pause", auth.Middleware(), handlers.PauseCampaignHandler())
+	campaignsApi.POST("/:id/resume", auth.Middleware(), handlers.ResumeCampaignHandler())
+	campaignsApi.POST("/:id/abort", auth.Middleware(), handlers.AbortCampaignHandler())
+
+	schedules := srv.Group("/api/schedules")
+	schedules.GET("/", auth.Middleware(), handlers.GetSchedulesHandler())
+	schedules.POST("/", auth.Middleware(), handlers.CreateScheduleHandler())
+	schedules.GET("/:id", auth.Middleware(), handlers.GetScheduleHandler())
+	schedules.POST("/:id/enabled", auth.Middleware(), handlers.SetScheduleEnabledHandler())
+	schedules.DELETE("/:id", auth.Middleware(), handlers.DeleteScheduleHandler())
+	schedules.GET("/:id/runs", auth.Middleware(), handlers.GetScheduleRunsHandler())
+
+	jobs := srv.Group("/api/jobs")
+	jobs.GET("/:jobId", auth.Middleware(), handlers.GetJobHandler())
+
+	admin := srv.Group("/api/admin")
+	admin.GET("/dead-letters", auth.Middleware(), handlers.GetDeadLettersHandler())
+	admin.GET("/dead-letters/:id", auth.Middleware(), handlers.GetDeadLetterHandler())
+	admin.POST("/dead-letters/:id/replay", auth.Middleware(), handlers.ReplayDeadLetterHandler())
 	return srv.Run(addr)
 }
@@ -0,0 +1,16 @@
+-- +migrate Up
+CREATE TABLE
+    IF NOT EXISTS deferred_requests (
+        request_id VARCHAR(256) PRIMARY KEY,
+        node_id UUID NOT NULL,
+        command VARCHAR(256) NOT NULL,
+        args JSONB,
+        timeout_seconds INTEGER NOT NULL DEFAULT 0,
+        created_at TIMESTAMPTZ NOT NULL,
+        expires_at TIMESTAMPTZ NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS deferred_requests_node_id_idx ON deferred_requests (node_id, created_at);
+
+-- +migrate Down
+DROP TABLE deferred_requests;
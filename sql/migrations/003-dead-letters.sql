@@ -0,0 +1,17 @@
+-- +migrate Up
+CREATE TABLE
+    IF NOT EXISTS dead_letters (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid (),
+        correlation_id VARCHAR(256),
+        reason VARCHAR(64) NOT NULL,
+        error TEXT NOT NULL,
+        body BYTEA,
+        content_type VARCHAR(256),
+        created_at TIMESTAMPTZ NOT NULL,
+        replayed_at TIMESTAMPTZ
+    );
+
+CREATE INDEX IF NOT EXISTS dead_letters_created_at_idx ON dead_letters (created_at);
+
+-- +migrate Down
+DROP TABLE dead_letters;
@@ -0,0 +1,13 @@
+-- +migrate Up
+ALTER TABLE deferred_requests
+ADD COLUMN IF NOT EXISTS reply_to VARCHAR(256) NOT NULL DEFAULT '';
+
+ALTER TABLE dead_letters
+ADD COLUMN IF NOT EXISTS reply_to VARCHAR(256) NOT NULL DEFAULT '';
+
+-- +migrate Down
+ALTER TABLE dead_letters
+DROP COLUMN reply_to;
+
+ALTER TABLE deferred_requests
+DROP COLUMN reply_to;
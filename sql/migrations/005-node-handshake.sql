@@ -0,0 +1,13 @@
+-- +migrate Up
+ALTER TABLE nodes
+ADD COLUMN IF NOT EXISTS protocol_version INTEGER NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS firmware_version VARCHAR(128) NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS model VARCHAR(128) NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS commands JSONB;
+
+-- +migrate Down
+ALTER TABLE nodes
+DROP COLUMN commands,
+DROP COLUMN model,
+DROP COLUMN firmware_version,
+DROP COLUMN protocol_version;
@@ -0,0 +1,20 @@
+-- +migrate Up
+CREATE TABLE
+    IF NOT EXISTS file_transfers (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid (),
+        node_id UUID REFERENCES nodes (id) ON DELETE CASCADE NOT NULL,
+        name VARCHAR(512) NOT NULL,
+        target VARCHAR(1024) NOT NULL DEFAULT '',
+        sha256 CHAR(64) NOT NULL,
+        size BIGINT NOT NULL,
+        "offset" BIGINT NOT NULL DEFAULT 0,
+        state VARCHAR(32) NOT NULL,
+        error TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMPTZ NOT NULL,
+        updated_at TIMESTAMPTZ NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS file_transfers_node_id_idx ON file_transfers (node_id, state);
+
+-- +migrate Down
+DROP TABLE file_transfers;
@@ -0,0 +1,21 @@
+-- +migrate Up
+CREATE TABLE
+    IF NOT EXISTS tunnel_sessions (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid (),
+        node_id UUID REFERENCES nodes (id) ON DELETE CASCADE NOT NULL,
+        organization_id UUID NOT NULL,
+        kind VARCHAR(32) NOT NULL,
+        target VARCHAR(512) NOT NULL DEFAULT '',
+        client_address VARCHAR(256) NOT NULL DEFAULT '',
+        user_agent TEXT NOT NULL DEFAULT '',
+        opened_at TIMESTAMPTZ NOT NULL,
+        closed_at TIMESTAMPTZ,
+        bytes_to_node BIGINT NOT NULL DEFAULT 0,
+        bytes_from_node BIGINT NOT NULL DEFAULT 0,
+        close_reason TEXT NOT NULL DEFAULT ''
+    );
+
+CREATE INDEX IF NOT EXISTS tunnel_sessions_node_id_idx ON tunnel_sessions (node_id, opened_at);
+
+-- +migrate Down
+DROP TABLE tunnel_sessions;
@@ -0,0 +1,24 @@
+-- +migrate Up
+CREATE TABLE
+    IF NOT EXISTS jobs (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid (),
+        node_id UUID REFERENCES nodes (id) ON DELETE CASCADE NOT NULL,
+        organization_id UUID NOT NULL,
+        command VARCHAR(256) NOT NULL,
+        args JSONB,
+        timeout_seconds INTEGER NOT NULL DEFAULT 0,
+        state VARCHAR(32) NOT NULL,
+        progress JSONB,
+        data JSONB,
+        request_error TEXT NOT NULL DEFAULT '',
+        command_error TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMPTZ NOT NULL,
+        sent_at TIMESTAMPTZ,
+        started_at TIMESTAMPTZ,
+        finished_at TIMESTAMPTZ
+    );
+
+CREATE INDEX IF NOT EXISTS jobs_node_id_idx ON jobs (node_id, state, created_at);
+
+-- +migrate Down
+DROP TABLE jobs;
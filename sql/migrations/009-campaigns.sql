@@ -0,0 +1,41 @@
+-- +migrate Up
+CREATE TABLE
+    IF NOT EXISTS campaigns (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid (),
+        organization_id UUID,
+        name VARCHAR(256) NOT NULL DEFAULT '',
+        command VARCHAR(256) NOT NULL,
+        args JSONB,
+        timeout_seconds INTEGER NOT NULL DEFAULT 0,
+        selector_tag VARCHAR(256) NOT NULL DEFAULT '',
+        wave_sizes JSONB NOT NULL,
+        success_threshold DOUBLE PRECISION NOT NULL DEFAULT 1,
+        pause_on_failure BOOLEAN NOT NULL DEFAULT TRUE,
+        state VARCHAR(32) NOT NULL,
+        current_wave INTEGER NOT NULL DEFAULT 0,
+        pause_reason TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMPTZ NOT NULL,
+        started_at TIMESTAMPTZ,
+        finished_at TIMESTAMPTZ,
+        updated_at TIMESTAMPTZ NOT NULL
+    );
+
+CREATE TABLE
+    IF NOT EXISTS campaign_nodes (
+        campaign_id UUID REFERENCES campaigns (id) ON DELETE CASCADE NOT NULL,
+        node_id UUID REFERENCES nodes (id) ON DELETE CASCADE NOT NULL,
+        wave INTEGER,
+        state VARCHAR(32) NOT NULL,
+        request_error TEXT NOT NULL DEFAULT '',
+        command_error TEXT NOT NULL DEFAULT '',
+        data JSONB,
+        updated_at TIMESTAMPTZ NOT NULL,
+        PRIMARY KEY (campaign_id, node_id)
+    );
+
+CREATE INDEX IF NOT EXISTS campaign_nodes_state_idx ON campaign_nodes (campaign_id, state);
+
+-- +migrate Down
+DROP TABLE campaign_nodes;
+
+DROP TABLE campaigns;
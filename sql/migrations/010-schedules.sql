@@ -0,0 +1,39 @@
+-- +migrate Up
+CREATE TABLE
+    IF NOT EXISTS schedules (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid (),
+        organization_id UUID,
+        name VARCHAR(256) NOT NULL DEFAULT '',
+        cron VARCHAR(256) NOT NULL,
+        timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+        command VARCHAR(256) NOT NULL,
+        args JSONB,
+        timeout_seconds INTEGER NOT NULL DEFAULT 0,
+        node_id UUID REFERENCES nodes (id) ON DELETE CASCADE,
+        selector_tag VARCHAR(256) NOT NULL DEFAULT '',
+        enabled BOOLEAN NOT NULL DEFAULT TRUE,
+        next_run_at TIMESTAMPTZ,
+        last_run_at TIMESTAMPTZ,
+        created_at TIMESTAMPTZ NOT NULL,
+        updated_at TIMESTAMPTZ NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS schedules_next_run_at_idx ON schedules (next_run_at)
+WHERE
+    enabled;
+
+CREATE TABLE
+    IF NOT EXISTS schedule_runs (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid (),
+        schedule_id UUID REFERENCES schedules (id) ON DELETE CASCADE NOT NULL,
+        node_id UUID REFERENCES nodes (id) ON DELETE CASCADE NOT NULL,
+        job_id UUID REFERENCES jobs (id) ON DELETE SET NULL,
+        scheduled_at TIMESTAMPTZ NOT NULL
+    );
+
+CREATE INDEX IF NOT EXISTS schedule_runs_schedule_id_idx ON schedule_runs (schedule_id, scheduled_at);
+
+-- +migrate Down
+DROP TABLE schedule_runs;
+
+DROP TABLE schedules;
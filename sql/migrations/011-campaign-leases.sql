@@ -0,0 +1,9 @@
+-- +migrate Up
+ALTER TABLE campaigns
+ADD COLUMN IF NOT EXISTS owner VARCHAR(64) NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS lease_until TIMESTAMPTZ;
+
+-- +migrate Down
+ALTER TABLE campaigns
+DROP COLUMN lease_until,
+DROP COLUMN owner;
@@ -0,0 +1,11 @@
+-- +migrate Up
+ALTER TABLE jobs
+ADD COLUMN IF NOT EXISTS deadline_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS jobs_state_idx ON jobs (state, created_at);
+
+-- +migrate Down
+DROP INDEX jobs_state_idx;
+
+ALTER TABLE jobs
+DROP COLUMN deadline_at;
@@ -0,0 +1,7 @@
+-- +migrate Up
+ALTER TABLE tunnel_sessions
+ADD COLUMN IF NOT EXISTS user_id UUID;
+
+-- +migrate Down
+ALTER TABLE tunnel_sessions
+DROP COLUMN user_id;
@@ -0,0 +1,241 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	CampaignStateCreated   = "created"
+	CampaignStateRunning   = "running"
+	CampaignStatePaused    = "paused"
+	CampaignStateCompleted = "completed"
+	CampaignStateFailed    = "failed"
+	CampaignStateAborted   = "aborted"
+)
+
+const (
+	CampaignNodeStatePending   = "pending"
+	CampaignNodeStateSent      = "sent"
+	CampaignNodeStateSucceeded = "succeeded"
+	CampaignNodeStateFailed    = "failed"
+	CampaignNodeStateSkipped   = "skipped"
+)
+
+type Campaign struct {
+	*ModelBase
+	// Nil for campaigns over every organization
+	OrganizationID   *uuid.UUID           `json:"organizationId"`
+	Name             string               `json:"name"`
+	Command          string               `json:"command"`
+	Args             JSON[map[string]any] `gorm:"type:jsonb" json:"args"`
+	TimeoutSeconds   int                  `json:"timeoutSeconds"`
+	SelectorTag      string               `json:"selectorTag"`
+	WaveSizes        JSON[[]int]          `gorm:"type:jsonb" json:"waveSizes"`
+	SuccessThreshold float64              `json:"successThreshold"`
+	PauseOnFailure   bool                 `json:"pauseOnFailure"`
+	State            string               `json:"state"`
+	CurrentWave      int                  `json:"currentWave"`
+	PauseReason      string               `json:"pauseReason"`
+	// Connector instance running the campaign while its lease lasts
+	Owner      string     `json:"owner"`
+	LeaseUntil *time.Time `json:"leaseUntil"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+}
+
+// CampaignNode is the outcome of a campaign on one node.
+type CampaignNode struct {
+	CampaignID   uuid.UUID            `gorm:"primary_key" json:"campaignId"`
+	NodeID       uuid.UUID            `gorm:"primary_key" json:"nodeId"`
+	Wave         *int                 `json:"wave"`
+	State        string               `json:"state"`
+	RequestError string               `json:"requestError"`
+	CommandError string               `json:"commandError"`
+	Data         JSON[map[string]any] `gorm:"type:jsonb" json:"data"`
+	UpdatedAt    time.Time            `json:"updatedAt"`
+}
+
+// NewCampaign stores the campaign together with its selected nodes.
+func NewCampaign(organizationID *uuid.UUID, name string, command string, args map[string]any, timeoutSeconds int, selectorTag string, waveSizes []int, successThreshold float64, pauseOnFailure bool, nodeIDs []uuid.UUID) (*Campaign, error) {
+	now := time.Now()
+	model := &Campaign{
+		ModelBase: &ModelBase{
+			ID: uuid.New(),
+		},
+		OrganizationID:   organizationID,
+		Name:             name,
+		Command:          command,
+		Args:             NewJSON(args),
+		TimeoutSeconds:   timeoutSeconds,
+		SelectorTag:      selectorTag,
+		WaveSizes:        NewJSON(waveSizes),
+		SuccessThreshold: successThreshold,
+		PauseOnFailure:   pauseOnFailure,
+		State:            CampaignStateCreated,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	nodes := make([]CampaignNode, 0, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		nodes = append(nodes, CampaignNode{
+			CampaignID: model.ID,
+			NodeID:     nodeID,
+			State:      CampaignNodeStatePending,
+			UpdatedAt:  now,
+		})
+	}
+
+	db := mustConnect()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(model).Error; err != nil {
+			return err
+		}
+		if len(nodes) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(nodes, 500).Error
+	})
+	if err != nil {
+		log.Error("failed to create campaign", "error", err.Error())
+		return nil, fmt.Errorf("failed to create campaign: %s", err)
+	}
+	return model, nil
+}
+
+func GetCampaign(id uuid.UUID) (*Campaign, error) {
+	db := mustConnect()
+	var campaign Campaign
+	err := db.Where("id = ?", id).First(&campaign).Error
+	if err != nil {
+		return nil, err
+	}
+	return &campaign, nil
+}
+
+func GetCampaignsByState(state string) ([]Campaign, error) {
+	db := mustConnect()
+	var campaigns []Campaign
+	err := db.Where("state = ?", state).Order("created_at").Find(&campaigns).Error
+	if err != nil {
+		return nil, err
+	}
+	return campaigns, nil
+}
+
+// UpdateCampaignState moves the campaign to the state only if it is in one
+// of the given states. It returns false when the campaign was in another
+// state.
+func UpdateCampaignState(id uuid.UUID, from []string, to string, fields map[string]any) (bool, error) {
+	updates := map[string]any{
+		"state":      to,
+		"updated_at": time.Now(),
+	}
+	for k, v := range fields {
+		updates[k] = v
+	}
+	db := mustConnect()
+	result := db.Model(&Campaign{}).Where("id = ? AND state IN ?", id, from).Updates(updates)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to update campaign: %s", result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// ClaimCampaign takes or renews the lease of the campaign for the owner. It
+// returns false while another owner holds a live lease.
+func ClaimCampaign(id uuid.UUID, owner string, leaseUntil time.Time) (bool, error) {
+	now := time.Now()
+	db := mustConnect()
+	result := db.Model(&Campaign{}).Where("id = ? AND (owner = ? OR lease_until IS NULL OR lease_until < ?)", id, owner, now).Updates(map[string]any{
+		"owner":       owner,
+		"lease_until": leaseUntil,
+		"updated_at":  now,
+	})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to claim campaign: %s", result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// ReleaseCampaign drops the lease of the owner, so another instance may
+// continue the campaign right away.
+func ReleaseCampaign(id uuid.UUID, owner string) error {
+	db := mustConnect()
+	err := db.Model(&Campaign{}).Where("id = ? AND owner = ?", id, owner).Updates(map[string]any{
+		"lease_until": nil,
+		"updated_at":  time.Now(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to release campaign: %s", err)
+	}
+	return nil
+}
+
+func GetCampaignNodes(campaignID uuid.UUID, state string, limit int, offset int) ([]CampaignNode, error) {
+	db := mustConnect()
+	query := db.Where("campaign_id = ?", campaignID)
+	if state != "" {
+		query = query.Where("state = ?", state)
+	}
+	var nodes []CampaignNode
+	err := query.Order("node_id").Limit(limit).Offset(offset).Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// CountCampaignNodes returns the number of nodes in every state.
+func CountCampaignNodes(campaignID uuid.UUID) (map[string]int, error) {
+	db := mustConnect()
+	var rows []struct {
+		State string
+		Count int
+	}
+	err := db.Model(&CampaignNode{}).Select("state, count(*) AS count").Where("campaign_id = ?", campaignID).Group("state").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, row := range rows {
+		counts[row.State] = row.Count
+	}
+	return counts, nil
+}
+
+func UpdateCampaignNode(campaignID uuid.UUID, nodeID uuid.UUID, state string, wave int, requestError string, commandError string, data map[string]any) error {
+	db := mustConnect()
+	err := db.Model(&CampaignNode{}).Where("campaign_id = ? AND node_id = ?", campaignID, nodeID).Updates(map[string]any{
+		"state":         state,
+		"wave":          wave,
+		"request_error": requestError,
+		"command_error": commandError,
+		"data":          NewJSON(data),
+		"updated_at":    time.Now(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update campaign node: %s", err)
+	}
+	return nil
+}
+
+// SetCampaignNodesState moves every node of the campaign in one state to
+// another.
+func SetCampaignNodesState(campaignID uuid.UUID, from string, to string) error {
+	db := mustConnect()
+	err := db.Model(&CampaignNode{}).Where("campaign_id = ? AND state = ?", campaignID, from).Updates(map[string]any{
+		"state":      to,
+		"updated_at": time.Now(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update campaign nodes: %s", err)
+	}
+	return nil
+}
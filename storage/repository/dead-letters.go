@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+)
+
+type DeadLetter struct {
+	*ModelBase
+	CorrelationID string     `json:"correlationId"`
+	ReplyTo       string     `json:"replyTo"`
+	Reason        string     `json:"reason"`
+	Error         string     `json:"error"`
+	Body          []byte     `json:"body"`
+	ContentType   string     `json:"contentType"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	ReplayedAt    *time.Time `json:"replayedAt"`
+}
+
+func NewDeadLetter(correlationID string, replyTo string, reason string, errorMessage string, body []byte, contentType string) (*DeadLetter, error) {
+	model := &DeadLetter{
+		ModelBase: &ModelBase{
+			ID: uuid.New(),
+		},
+		CorrelationID: correlationID,
+		ReplyTo:       replyTo,
+		Reason:        reason,
+		Error:         errorMessage,
+		Body:          body,
+		ContentType:   contentType,
+		CreatedAt:     time.Now(),
+	}
+	db := mustConnect()
+	err := db.Create(model).Error
+	if err != nil {
+		log.Error("failed to create dead letter", "error", err.Error())
+		return nil, fmt.Errorf("failed to create dead letter: %s", err)
+	}
+	return model, nil
+}
+
+func GetDeadLetters(limit int, offset int) ([]DeadLetter, error) {
+	db := mustConnect()
+	var letters []DeadLetter
+	err := db.Order("created_at DESC").Limit(limit).Offset(offset).Find(&letters).Error
+	if err != nil {
+		return nil, err
+	}
+	return letters, nil
+}
+
+func GetDeadLetter(id uuid.UUID) (*DeadLetter, error) {
+	db := mustConnect()
+	var letter DeadLetter
+	err := db.Where("id = ?", id).First(&letter).Error
+	if err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+func MarkDeadLetterReplayed(id uuid.UUID) error {
+	db := mustConnect()
+	err := db.Model(&DeadLetter{}).Where("id = ?", id).Update("replayed_at", time.Now()).Error
+	if err != nil {
+		return fmt.Errorf("failed to update dead letter: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+)
+
+type DeferredRequest struct {
+	RequestID      string               `gorm:"primary_key" json:"requestId"`
+	ReplyTo        string               `json:"replyTo"`
+	NodeID         uuid.UUID            `json:"nodeId"`
+	Command        string               `json:"command"`
+	Args           JSON[map[string]any] `gorm:"type:jsonb" json:"args"`
+	TimeoutSeconds int                  `json:"timeoutSeconds"`
+	CreatedAt      time.Time            `json:"createdAt"`
+	ExpiresAt      time.Time            `json:"expiresAt"`
+}
+
+func NewDeferredRequest(requestID string, replyTo string, nodeID uuid.UUID, command string, args map[string]any, timeoutSeconds int, expiresAt time.Time) (*DeferredRequest, error) {
+	model := &DeferredRequest{
+		RequestID:      requestID,
+		ReplyTo:        replyTo,
+		NodeID:         nodeID,
+		Command:        command,
+		Args:           NewJSON(args),
+		TimeoutSeconds: timeoutSeconds,
+		CreatedAt:      time.Now(),
+		ExpiresAt:      expiresAt,
+	}
+	db := mustConnect()
+	err := db.Create(model).Error
+	if err != nil {
+		log.Error("failed to create deferred request", "error", err.Error())
+		return nil, fmt.Errorf("failed to create deferred request: %s", err)
+	}
+	return model, nil
+}
+
+// GetDeferredRequests returns not expired requests of the node in the order
+// they were received.
+func GetDeferredRequests(nodeID uuid.UUID) ([]DeferredRequest, error) {
+	db := mustConnect()
+	var requests []DeferredRequest
+	err := db.Where("node_id = ? AND expires_at > ?", nodeID, time.Now()).Order("created_at").Find(&requests).Error
+	if err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+func RemoveDeferredRequest(requestID string) error {
+	db := mustConnect()
+	err := db.Where("request_id = ?", requestID).Delete(&DeferredRequest{}).Error
+	if err != nil {
+		log.Error("failed to delete deferred request", "error", err.Error())
+		return fmt.Errorf("failed to delete deferred request: %s", err)
+	}
+	return nil
+}
+
+// RemoveExpiredDeferredRequests deletes expired requests and returns them,
+// so every expired request is reported exactly once.
+func RemoveExpiredDeferredRequests() ([]DeferredRequest, error) {
+	db := mustConnect()
+	var requests []DeferredRequest
+	err := db.Clauses(clause.Returning{}).Where("expires_at <= ?", time.Now()).Delete(&requests).Error
+	if err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+)
+
+const (
+	JobStateQueued    = "queued"
+	JobStateSent      = "sent"
+	JobStateRunning   = "running"
+	JobStateSucceeded = "succeeded"
+	JobStateFailed    = "failed"
+	JobStateTimedOut  = "timed_out"
+)
+
+type Job struct {
+	*ModelBase
+	NodeID         uuid.UUID            `json:"nodeId"`
+	OrganizationID uuid.UUID            `json:"organizationId"`
+	Command        string               `json:"command"`
+	Args           JSON[map[string]any] `gorm:"type:jsonb" json:"args"`
+	TimeoutSeconds int                  `json:"timeoutSeconds"`
+	State          string               `json:"state"`
+	Progress       JSON[map[string]any] `gorm:"type:jsonb" json:"progress"`
+	Data           JSON[map[string]any] `gorm:"type:jsonb" json:"data"`
+	RequestError   string               `json:"requestError"`
+	CommandError   string               `json:"commandError"`
+	CreatedAt      time.Time            `json:"createdAt"`
+	SentAt         *time.Time           `json:"sentAt"`
+	StartedAt      *time.Time           `json:"startedAt"`
+	FinishedAt     *time.Time           `json:"finishedAt"`
+	// Sent and running jobs not answered by then are timed out
+	DeadlineAt *time.Time `json:"deadlineAt"`
+}
+
+func NewJob(nodeID uuid.UUID, organizationID uuid.UUID, command string, args map[string]any, timeoutSeconds int) (*Job, error) {
+	model := &Job{
+		ModelBase: &ModelBase{
+			ID: uuid.New(),
+		},
+		NodeID:         nodeID,
+		OrganizationID: organizationID,
+		Command:        command,
+		Args:           NewJSON(args),
+		TimeoutSeconds: timeoutSeconds,
+		State:          JobStateQueued,
+		CreatedAt:      time.Now(),
+	}
+	db := mustConnect()
+	err := db.Create(model).Error
+	if err != nil {
+		log.Error("failed to create job", "error", err.Error())
+		return nil, fmt.Errorf("failed to create job: %s", err)
+	}
+	return model, nil
+}
+
+func GetJob(id uuid.UUID) (*Job, error) {
+	db := mustConnect()
+	var job Job
+	err := db.Where("id = ?", id).First(&job).Error
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// GetQueuedJobs returns jobs waiting for the node to connect, oldest first.
+func GetQueuedJobs(nodeID uuid.UUID) ([]Job, error) {
+	db := mustConnect()
+	var jobs []Job
+	err := db.Where("node_id = ? AND state = ?", nodeID, JobStateQueued).Order("created_at").Find(&jobs).Error
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// GetQueuedJobNodes returns the nodes having queued jobs.
+func GetQueuedJobNodes() ([]uuid.UUID, error) {
+	db := mustConnect()
+	var nodeIDs []uuid.UUID
+	err := db.Model(&Job{}).Where("state = ?", JobStateQueued).Distinct().Pluck("node_id", &nodeIDs).Error
+	if err != nil {
+		return nil, err
+	}
+	return nodeIDs, nil
+}
+
+// UpdateJobState moves the job to the state only if it is in one of the
+// given states, so a late update can't overwrite a finished job. It returns
+// false when the job was in another state.
+func UpdateJobState(id uuid.UUID, from []string, to string, fields map[string]any) (bool, error) {
+	updates := map[string]any{
+		"state": to,
+	}
+	for k, v := range fields {
+		updates[k] = v
+	}
+	db := mustConnect()
+	result := db.Model(&Job{}).Where("id = ? AND state IN ?", id, from).Updates(updates)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to update job: %s", result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// TimeOutQueuedJobs finishes jobs still queued that were created before the
+// time, it returns the number of finished jobs.
+func TimeOutQueuedJobs(createdBefore time.Time, requestError string) (int64, error) {
+	db := mustConnect()
+	result := db.Model(&Job{}).Where("state = ? AND created_at < ?", JobStateQueued, createdBefore).Updates(map[string]any{
+		"state":         JobStateTimedOut,
+		"request_error": requestError,
+		"finished_at":   time.Now(),
+	})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to time out queued jobs: %s", result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+// TimeOutStaleJobs finishes sent and running jobs whose deadline passed
+// before the time. Nobody waits for their response anymore, like after a
+// restart of the connector that sent them.
+func TimeOutStaleJobs(deadlineBefore time.Time, requestError string) (int64, error) {
+	db := mustConnect()
+	result := db.Model(&Job{}).Where("state IN ? AND deadline_at < ?", []string{JobStateSent, JobStateRunning}, deadlineBefore).Updates(map[string]any{
+		"state":         JobStateTimedOut,
+		"request_error": requestError,
+		"finished_at":   time.Now(),
+	})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to time out stale jobs: %s", result.Error)
+	}
+	return result.RowsAffected, nil
+}
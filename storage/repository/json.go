@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// JSON is a value stored in a JSONB column, nil maps and slices are stored
+// as NULL. It is encoded to JSON as the value itself.
+type JSON[T any] struct {
+	Val T
+}
+
+func NewJSON[T any](v T) JSON[T] {
+	return JSON[T]{Val: v}
+}
+
+func (j JSON[T]) Value() (driver.Value, error) {
+	data, err := json.Marshal(j.Val)
+	if err != nil {
+		return nil, err
+	}
+	if string(data) == "null" {
+		return nil, nil
+	}
+	return data, nil
+}
+
+func (j *JSON[T]) Scan(value any) error {
+	var zero T
+	j.Val = zero
+	if value == nil {
+		return nil
+	}
+	var data []byte
+	switch v := value.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported type %T for json column", value)
+	}
+	return json.Unmarshal(data, &j.Val)
+}
+
+func (j JSON[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(j.Val)
+}
+
+func (j *JSON[T]) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &j.Val)
+}
@@ -29,6 +29,11 @@ type Node struct {
 	FirstConnection time.Time  `json:"firstConnection"`
 	LastConnection  *time.Time `json:"lastConnection"`
 	Tags            []*Tag     `gorm:"foreignKey:NodeID" json:"tags"`
+	// Reported by the node in the handshake
+	ProtocolVersion int            `json:"protocolVersion"`
+	FirmwareVersion string         `json:"firmwareVersion"`
+	Model           string         `json:"model"`
+	Commands        JSON[[]string] `gorm:"type:jsonb" json:"commands"`
 }
 
 type Tag struct {
@@ -117,3 +122,37 @@ func UpdateLastConnection(id uuid.UUID) (*Node, error) {
 	}
 	return &node, nil
 }
+
+func UpdateNodeHandshake(id uuid.UUID, protocolVersion int, firmwareVersion string, model string, commands []string) error {
+	db := mustConnect()
+	err := db.Model(&Node{}).Where("id = ?", id).Updates(map[string]any{
+		"protocol_version": protocolVersion,
+		"firmware_version": firmwareVersion,
+		"model":            model,
+		"commands":         NewJSON(commands),
+	}).Error
+	if err != nil {
+		log.Error("failed to update node handshake", "error", err.Error())
+		return fmt.Errorf("failed to update node handshake: %s", err)
+	}
+	return nil
+}
+
+// GetNodesBySelector returns nodes of the organization, every organization
+// when it is nil, having the tag unless it is empty.
+func GetNodesBySelector(organizationID *uuid.UUID, tag string) ([]Node, error) {
+	db := mustConnect()
+	query := db.Preload("Tags")
+	if organizationID != nil {
+		query = query.Where("organization_id = ?", *organizationID)
+	}
+	if tag != "" {
+		query = query.Where("id IN (?)", db.Model(&Tag{}).Select("node_id").Where("tag = ?", tag))
+	}
+	var nodes []Node
+	err := query.Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
@@ -0,0 +1,174 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+)
+
+type Schedule struct {
+	*ModelBase
+	// Nil for schedules over every organization
+	OrganizationID *uuid.UUID           `json:"organizationId"`
+	Name           string               `json:"name"`
+	Cron           string               `json:"cron"`
+	Timezone       string               `json:"timezone"`
+	Command        string               `json:"command"`
+	Args           JSON[map[string]any] `gorm:"type:jsonb" json:"args"`
+	TimeoutSeconds int                  `json:"timeoutSeconds"`
+	// Either the node or the tag is targeted
+	NodeID      *uuid.UUID `json:"nodeId"`
+	SelectorTag string     `json:"selectorTag"`
+	Enabled     bool       `json:"enabled"`
+	NextRunAt   *time.Time `json:"nextRunAt"`
+	LastRunAt   *time.Time `json:"lastRunAt"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+}
+
+// ScheduleRun is a command sent to one node by a schedule, its outcome is
+// kept in the job.
+type ScheduleRun struct {
+	*ModelBase
+	ScheduleID  uuid.UUID  `json:"scheduleId"`
+	NodeID      uuid.UUID  `json:"nodeId"`
+	JobID       *uuid.UUID `json:"jobId"`
+	ScheduledAt time.Time  `json:"scheduledAt"`
+	Job         *Job       `gorm:"foreignKey:JobID" json:"job"`
+}
+
+func NewSchedule(organizationID *uuid.UUID, name string, cron string, timezone string, command string, args map[string]any, timeoutSeconds int, nodeID *uuid.UUID, selectorTag string, nextRunAt time.Time) (*Schedule, error) {
+	now := time.Now()
+	model := &Schedule{
+		ModelBase: &ModelBase{
+			ID: uuid.New(),
+		},
+		OrganizationID: organizationID,
+		Name:           name,
+		Cron:           cron,
+		Timezone:       timezone,
+		Command:        command,
+		Args:           NewJSON(args),
+		TimeoutSeconds: timeoutSeconds,
+		NodeID:         nodeID,
+		SelectorTag:    selectorTag,
+		Enabled:        true,
+		NextRunAt:      &nextRunAt,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	db := mustConnect()
+	err := db.Create(model).Error
+	if err != nil {
+		log.Error("failed to create schedule", "error", err.Error())
+		return nil, fmt.Errorf("failed to create schedule: %s", err)
+	}
+	return model, nil
+}
+
+func GetSchedule(id uuid.UUID) (*Schedule, error) {
+	db := mustConnect()
+	var schedule Schedule
+	err := db.Where("id = ?", id).First(&schedule).Error
+	if err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+// GetSchedules returns schedules of the organization, every schedule when it
+// is nil.
+func GetSchedules(organizationID *uuid.UUID) ([]Schedule, error) {
+	db := mustConnect()
+	query := db.Order("created_at")
+	if organizationID != nil {
+		query = query.Where("organization_id = ?", *organizationID)
+	}
+	var schedules []Schedule
+	err := query.Find(&schedules).Error
+	if err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+func GetDueSchedules(now time.Time) ([]Schedule, error) {
+	db := mustConnect()
+	var schedules []Schedule
+	err := db.Where("enabled AND next_run_at <= ?", now).Order("next_run_at").Find(&schedules).Error
+	if err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+// ClaimScheduleRun moves the next run of the schedule forward only if it
+// wasn't moved by someone else, so every run is executed by one connector
+// instance.
+func ClaimScheduleRun(id uuid.UUID, dueAt time.Time, nextRunAt *time.Time) (bool, error) {
+	now := time.Now()
+	db := mustConnect()
+	result := db.Model(&Schedule{}).Where("id = ? AND next_run_at = ?", id, dueAt).Updates(map[string]any{
+		"next_run_at": nextRunAt,
+		"last_run_at": now,
+		"updated_at":  now,
+	})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to claim schedule run: %s", result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func UpdateScheduleEnabled(id uuid.UUID, enabled bool, nextRunAt *time.Time) error {
+	db := mustConnect()
+	err := db.Model(&Schedule{}).Where("id = ?", id).Updates(map[string]any{
+		"enabled":     enabled,
+		"next_run_at": nextRunAt,
+		"updated_at":  time.Now(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update schedule: %s", err)
+	}
+	return nil
+}
+
+func RemoveSchedule(id uuid.UUID) error {
+	db := mustConnect()
+	err := db.Where("id = ?", id).Delete(&Schedule{}).Error
+	if err != nil {
+		return fmt.Errorf("failed to remove schedule: %s", err)
+	}
+	return nil
+}
+
+func NewScheduleRun(scheduleID uuid.UUID, nodeID uuid.UUID, jobID *uuid.UUID, scheduledAt time.Time) (*ScheduleRun, error) {
+	model := &ScheduleRun{
+		ModelBase: &ModelBase{
+			ID: uuid.New(),
+		},
+		ScheduleID:  scheduleID,
+		NodeID:      nodeID,
+		JobID:       jobID,
+		ScheduledAt: scheduledAt,
+	}
+	db := mustConnect()
+	err := db.Omit("Job").Create(model).Error
+	if err != nil {
+		log.Error("failed to create schedule run", "error", err.Error())
+		return nil, fmt.Errorf("failed to create schedule run: %s", err)
+	}
+	return model, nil
+}
+
+// GetScheduleRuns returns runs of the schedule with their jobs, newest first.
+func GetScheduleRuns(scheduleID uuid.UUID, limit int, offset int) ([]ScheduleRun, error) {
+	db := mustConnect()
+	var runs []ScheduleRun
+	err := db.Preload("Job").Where("schedule_id = ?", scheduleID).Order("scheduled_at DESC").Limit(limit).Offset(offset).Find(&runs).Error
+	if err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
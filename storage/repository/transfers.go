@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+)
+
+const (
+	TransferStatePending   = "pending"
+	TransferStateSending   = "sending"
+	TransferStateCompleted = "completed"
+	TransferStateFailed    = "failed"
+)
+
+type FileTransfer struct {
+	*ModelBase
+	NodeID    uuid.UUID `json:"nodeId"`
+	Name      string    `json:"name"`
+	Target    string    `json:"target"`
+	Sha256    string    `gorm:"column:sha256" json:"sha256"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	State     string    `json:"state"`
+	Error     string    `json:"error"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func NewFileTransfer(nodeID uuid.UUID, name string, target string, sha256 string, size int64) (*FileTransfer, error) {
+	now := time.Now()
+	model := &FileTransfer{
+		ModelBase: &ModelBase{
+			ID: uuid.New(),
+		},
+		NodeID:    nodeID,
+		Name:      name,
+		Target:    target,
+		Sha256:    sha256,
+		Size:      size,
+		State:     TransferStatePending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	db := mustConnect()
+	err := db.Create(model).Error
+	if err != nil {
+		log.Error("failed to create file transfer", "error", err.Error())
+		return nil, fmt.Errorf("failed to create file transfer: %s", err)
+	}
+	return model, nil
+}
+
+func GetFileTransfer(id uuid.UUID) (*FileTransfer, error) {
+	db := mustConnect()
+	var transfer FileTransfer
+	err := db.Where("id = ?", id).First(&transfer).Error
+	if err != nil {
+		return nil, err
+	}
+	return &transfer, nil
+}
+
+// GetUnfinishedFileTransfers returns transfers of the node to start or
+// resume, oldest first.
+func GetUnfinishedFileTransfers(nodeID uuid.UUID) ([]FileTransfer, error) {
+	db := mustConnect()
+	var transfers []FileTransfer
+	err := db.Where("node_id = ? AND state IN ?", nodeID, []string{TransferStatePending, TransferStateSending}).Order("created_at").Find(&transfers).Error
+	if err != nil {
+		return nil, err
+	}
+	return transfers, nil
+}
+
+func UpdateFileTransfer(id uuid.UUID, state string, offset int64, errorMessage string) error {
+	db := mustConnect()
+	err := db.Model(&FileTransfer{}).Where("id = ?", id).Updates(map[string]any{
+		"state":      state,
+		"offset":     offset,
+		"error":      errorMessage,
+		"updated_at": time.Now(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update file transfer: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+)
+
+// TunnelSession is the audit record of a tunnel opened to a node.
+type TunnelSession struct {
+	*ModelBase
+	NodeID         uuid.UUID  `json:"nodeId"`
+	OrganizationID uuid.UUID  `json:"organizationId"`
+	UserID         uuid.UUID  `json:"userId"`
+	Kind           string     `json:"kind"`
+	Target         string     `json:"target"`
+	ClientAddress  string     `json:"clientAddress"`
+	UserAgent      string     `json:"userAgent"`
+	OpenedAt       time.Time  `json:"openedAt"`
+	ClosedAt       *time.Time `json:"closedAt"`
+	BytesToNode    int64      `json:"bytesToNode"`
+	BytesFromNode  int64      `json:"bytesFromNode"`
+	CloseReason    string     `json:"closeReason"`
+}
+
+func NewTunnelSession(id uuid.UUID, nodeID uuid.UUID, organizationID uuid.UUID, userID uuid.UUID, kind string, target string, clientAddress string, userAgent string) (*TunnelSession, error) {
+	model := &TunnelSession{
+		ModelBase: &ModelBase{
+			ID: id,
+		},
+		NodeID:         nodeID,
+		OrganizationID: organizationID,
+		UserID:         userID,
+		Kind:           kind,
+		Target:         target,
+		ClientAddress:  clientAddress,
+		UserAgent:      userAgent,
+		OpenedAt:       time.Now(),
+	}
+	db := mustConnect()
+	err := db.Create(model).Error
+	if err != nil {
+		log.Error("failed to create tunnel session", "error", err.Error())
+		return nil, fmt.Errorf("failed to create tunnel session: %s", err)
+	}
+	return model, nil
+}
+
+func CloseTunnelSession(id uuid.UUID, bytesToNode int64, bytesFromNode int64, reason string) error {
+	db := mustConnect()
+	err := db.Model(&TunnelSession{}).Where("id = ?", id).Updates(map[string]any{
+		"closed_at":       time.Now(),
+		"bytes_to_node":   bytesToNode,
+		"bytes_from_node": bytesFromNode,
+		"close_reason":    reason,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to close tunnel session: %s", err)
+	}
+	return nil
+}
+
+func GetTunnelSessions(nodeID uuid.UUID, limit int, offset int) ([]TunnelSession, error) {
+	db := mustConnect()
+	var sessions []TunnelSession
+	err := db.Where("node_id = ?", nodeID).Order("opened_at DESC").Limit(limit).Offset(offset).Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
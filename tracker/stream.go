@@ -0,0 +1,190 @@
+package tracker
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"github.com/zarinit-routers/cloud-connector/config"
+	"github.com/zarinit-routers/cloud-connector/models"
+)
+
+const (
+	ENV_STREAM_MAX_BUFFERED_BYTES = "STREAM_MAX_BUFFERED_BYTES"
+
+	RequestErrorResponseTooLarge = "response too large"
+	RequestErrorBadStream        = "bad response stream"
+)
+
+func getMaxBufferedBytes() int {
+	return config.Int(ENV_STREAM_MAX_BUFFERED_BYTES, 16<<20)
+}
+
+// PartFunc publishes a single part of a forwarded stream. The final part
+// carries the command result or the error that ended the stream.
+type PartFunc func(seq int, final bool, response *models.ToCloudResponse)
+
+// stream collects chunks of a streamed response. Chunks may arrive out of
+// order, forwarded chunks are held back until all previous ones are sent.
+type stream struct {
+	mu     sync.Mutex
+	mode   string
+	part   PartFunc
+	chunks map[int][]byte
+	size   int
+	// next is the sequence number of the next chunk to forward
+	next int
+	// total is the number of data chunks, known from the terminal frame
+	total    int
+	terminal *models.FromNodeChunk
+	done     bool
+}
+
+func newStream(mode string, part PartFunc) *stream {
+	if mode == "" {
+		mode = models.StreamReassemble
+	}
+	return &stream{
+		mode:   mode,
+		part:   part,
+		chunks: map[int][]byte{},
+		total:  -1,
+	}
+}
+
+func (s *stream) forwarding() bool {
+	return s.mode == models.StreamForward && s.part != nil
+}
+
+// SetStream sets how chunks of the request response are published, requests
+// are reassembled unless configured otherwise.
+func (t *Tracker) SetStream(id string, mode string, part PartFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if request, ok := t.requests[id]; ok {
+		request.stream = newStream(mode, part)
+	}
+}
+
+// Chunk adds a chunk of a streamed response, every chunk extends the
+// deadline of the request. It returns false for chunks of unknown requests.
+func (t *Tracker) Chunk(nodeID models.UUID, chunk *models.FromNodeChunk) bool {
+	t.mu.Lock()
+	request, ok := t.requests[chunk.RequestID]
+	// A request whose timer already fired is timing out
+	ok = ok && request.NodeID == nodeID && request.timer.Stop()
+	if ok {
+		if request.stream == nil {
+			request.stream = newStream(models.StreamReassemble, nil)
+		}
+		request.Deadline = request.extend()
+	}
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	s := request.stream
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return false
+	}
+
+	if chunk.Final {
+		if s.total >= 0 || chunk.Seq < s.next || chunk.Seq < maxSeq(s.chunks)+1 {
+			t.failStream(request, RequestErrorBadStream)
+			return true
+		}
+		s.total = chunk.Seq
+		s.terminal = chunk
+	} else {
+		if _, ok := s.chunks[chunk.Seq]; ok || chunk.Seq < s.next || (s.total >= 0 && chunk.Seq >= s.total) {
+			log.Warn("Dropping duplicate or out of range chunk", "requestId", request.ID, "seq", chunk.Seq)
+			return true
+		}
+		if s.size+len(chunk.Chunk) > getMaxBufferedBytes() {
+			t.failStream(request, RequestErrorResponseTooLarge)
+			return true
+		}
+		s.chunks[chunk.Seq] = chunk.Chunk
+		s.size += len(chunk.Chunk)
+	}
+
+	if s.forwarding() {
+		for data, ok := s.chunks[s.next]; ok; data, ok = s.chunks[s.next] {
+			s.part(s.next, false, &models.ToCloudResponse{
+				Data: models.JsonMap{"chunk": data},
+			})
+			delete(s.chunks, s.next)
+			s.size -= len(data)
+			s.next++
+		}
+		if s.total >= 0 && s.next == s.total && t.remove(request) {
+			s.done = true
+			s.part(s.total, true, s.terminalResponse())
+		}
+		return true
+	}
+
+	if s.total >= 0 && len(s.chunks) == s.total && t.remove(request) {
+		s.done = true
+		response := s.terminalResponse()
+		var content bytes.Buffer
+		for seq := range s.total {
+			content.Write(s.chunks[seq])
+		}
+		if response.Data == nil {
+			response.Data = models.JsonMap{}
+		}
+		response.Data["content"] = content.Bytes()
+		response.Data["contentEncoding"] = "base64"
+		request.reply(response)
+	}
+	return true
+}
+
+func (s *stream) terminalResponse() *models.ToCloudResponse {
+	return &models.ToCloudResponse{
+		CommandError: s.terminal.Error,
+		Data:         s.terminal.Data,
+	}
+}
+
+// failStream ends the request with an error, the stream lock must be held.
+func (t *Tracker) failStream(request *Request, reason string) {
+	log.Warn("Failing streamed request", "requestId", request.ID, "reason", reason)
+	if !t.remove(request) {
+		return
+	}
+	request.stream.done = true
+	request.stream.finish(request, &models.ToCloudResponse{
+		RequestError: reason,
+	})
+}
+
+// finish delivers the final response, as the final part of a forwarded
+// stream or as a regular reply. The stream lock must be held.
+func (s *stream) finish(request *Request, response *models.ToCloudResponse) {
+	if s.forwarding() {
+		s.part(s.next, true, response)
+		return
+	}
+	request.reply(response)
+}
+
+func maxSeq(chunks map[int][]byte) int {
+	seq := -1
+	for k := range chunks {
+		seq = max(seq, k)
+	}
+	return seq
+}
+
+func SetStream(id string, mode string, part PartFunc) {
+	pending.SetStream(id, mode, part)
+}
+
+func Chunk(nodeID models.UUID, chunk *models.FromNodeChunk) bool {
+	return pending.Chunk(nodeID, chunk)
+}
@@ -0,0 +1,121 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zarinit-routers/cloud-connector/models"
+)
+
+func chunk(id string, seq int, data string) *models.FromNodeChunk {
+	return &models.FromNodeChunk{RequestID: id, Seq: seq, Chunk: []byte(data)}
+}
+
+func final(id string, seq int) *models.FromNodeChunk {
+	return &models.FromNodeChunk{RequestID: id, Seq: seq, Final: true, Data: models.JsonMap{"done": true}}
+}
+
+func TestReassemble(t *testing.T) {
+	tr := New()
+	node := uuid.New()
+	r := newReplies()
+	if err := tr.Track("a", node, "logs", time.Minute, r.reply); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*models.FromNodeChunk{chunk("a", 2, "c"), final("a", 3), chunk("a", 0, "a"), chunk("a", 1, "b")} {
+		if !tr.Chunk(node, c) {
+			t.Fatalf("chunk %d dropped", c.Seq)
+		}
+	}
+	response := r.wait(t)
+	if string(response.Data["content"].([]byte)) != "abc" || response.Data["done"] != true {
+		t.Fatalf("got %+v", response)
+	}
+	if tr.Chunk(node, chunk("a", 3, "d")) {
+		t.Fatal("chunk of finished request accepted")
+	}
+}
+
+func TestReassembleTooLarge(t *testing.T) {
+	t.Setenv(ENV_STREAM_MAX_BUFFERED_BYTES, "4")
+	tr := New()
+	node := uuid.New()
+	r := newReplies()
+	if err := tr.Track("a", node, "logs", time.Minute, r.reply); err != nil {
+		t.Fatal(err)
+	}
+
+	tr.Chunk(node, chunk("a", 0, "abc"))
+	tr.Chunk(node, chunk("a", 1, "de"))
+	if response := r.wait(t); response.RequestError != RequestErrorResponseTooLarge {
+		t.Fatalf("got %+v", response)
+	}
+	if tr.Len() != 0 || tr.Chunk(node, chunk("a", 2, "f")) {
+		t.Fatal("request still pending")
+	}
+}
+
+func TestBadFinal(t *testing.T) {
+	tr := New()
+	node := uuid.New()
+	r := newReplies()
+	if err := tr.Track("a", node, "logs", time.Minute, r.reply); err != nil {
+		t.Fatal(err)
+	}
+
+	tr.Chunk(node, chunk("a", 2, "c"))
+	// The terminal frame says there are fewer chunks than already received
+	tr.Chunk(node, final("a", 1))
+	if response := r.wait(t); response.RequestError != RequestErrorBadStream {
+		t.Fatalf("got %+v", response)
+	}
+}
+
+func TestChunkOfOtherNode(t *testing.T) {
+	tr := New()
+	node := uuid.New()
+	if err := tr.Track("a", node, "logs", time.Minute, newReplies().reply); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Chunk(uuid.New(), chunk("a", 0, "a")) {
+		t.Fatal("chunk of another node accepted")
+	}
+}
+
+func TestForward(t *testing.T) {
+	tr := New()
+	node := uuid.New()
+	if err := tr.Track("a", node, "logs", time.Minute, newReplies().reply); err != nil {
+		t.Fatal(err)
+	}
+	type part struct {
+		seq   int
+		final bool
+		data  string
+	}
+	parts := make(chan part, 10)
+	tr.SetStream("a", models.StreamForward, func(seq int, final bool, response *models.ToCloudResponse) {
+		data, _ := response.Data["chunk"].([]byte)
+		parts <- part{seq, final, string(data)}
+	})
+
+	for _, c := range []*models.FromNodeChunk{chunk("a", 1, "b"), chunk("a", 0, "a"), final("a", 3), chunk("a", 2, "c")} {
+		tr.Chunk(node, c)
+	}
+	want := []part{{0, false, "a"}, {1, false, "b"}, {2, false, "c"}, {3, true, ""}}
+	for _, w := range want {
+		select {
+		case got := <-parts:
+			if got != w {
+				t.Fatalf("got %+v, want %+v", got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("missing part %+v", w)
+		}
+	}
+	if tr.Len() != 0 {
+		t.Fatal("request still pending")
+	}
+}
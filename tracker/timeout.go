@@ -0,0 +1,56 @@
+package tracker
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/zarinit-routers/cloud-connector/config"
+)
+
+const (
+	ENV_REQUEST_TIMEOUT  = "REQUEST_TIMEOUT"
+	ENV_COMMAND_TIMEOUTS = "COMMAND_TIMEOUTS"
+)
+
+func getDefaultTimeout() time.Duration {
+	return config.Duration(ENV_REQUEST_TIMEOUT, 30*time.Second)
+}
+
+// getCommandTimeouts parses per-command deadlines in the form
+// "command=duration,command=duration".
+func getCommandTimeouts() map[string]time.Duration {
+	timeouts := map[string]time.Duration{}
+	for _, pair := range strings.Split(os.Getenv(ENV_COMMAND_TIMEOUTS), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		command, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			log.Warn("Bad command timeout, expected command=duration", "envVariable", ENV_COMMAND_TIMEOUTS, "value", pair)
+			continue
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || timeout <= 0 {
+			log.Warn("Bad command timeout duration", "envVariable", ENV_COMMAND_TIMEOUTS, "value", pair, "error", err)
+			continue
+		}
+		timeouts[strings.TrimSpace(command)] = timeout
+	}
+	return timeouts
+}
+
+var commandTimeouts = getCommandTimeouts()
+
+// Timeout picks the deadline of a request: the one requested by the cloud,
+// then the configured one of the command, then the default one.
+func Timeout(command string, requested time.Duration) time.Duration {
+	if requested > 0 {
+		return requested
+	}
+	if timeout, ok := commandTimeouts[command]; ok {
+		return timeout
+	}
+	return getDefaultTimeout()
+}
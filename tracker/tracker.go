@@ -0,0 +1,246 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/zarinit-routers/cloud-connector/models"
+)
+
+const (
+	RequestErrorTimeout          = "timeout"
+	RequestErrorNodeDisconnected = "node disconnected"
+)
+
+var (
+	ErrEmptyRequestID     = errors.New("empty request id")
+	ErrDuplicateRequestID = errors.New("request with that id is already pending")
+)
+
+// ReplyFunc delivers the final response of a tracked request back to the
+// cloud, it is called exactly once per request unless it was cancelled.
+type ReplyFunc func(response *models.ToCloudResponse)
+
+type Request struct {
+	ID     string
+	NodeID models.UUID
+	// SessionID is the node connection the request was written to
+	SessionID    string
+	Command      string
+	DispatchedAt time.Time
+	Deadline     time.Time
+
+	reply   ReplyFunc
+	timeout time.Duration
+	timer   *time.Timer
+	stream  *stream
+}
+
+// extend restarts the deadline, the tracker lock must be held.
+func (r *Request) extend() time.Time {
+	r.timer.Reset(r.timeout)
+	return time.Now().Add(r.timeout)
+}
+
+// deliver sends the final response of a request already removed from the
+// tracker.
+func (r *Request) deliver(response *models.ToCloudResponse) {
+	t := r.stream
+	if t == nil {
+		r.reply(response)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return
+	}
+	t.done = true
+	t.finish(r, response)
+}
+
+// Tracker is a table of requests sent to nodes and not answered yet.
+type Tracker struct {
+	mu        sync.Mutex
+	requests  map[string]*Request
+	bySession map[string]map[string]*Request
+}
+
+func New() *Tracker {
+	return &Tracker{
+		requests:  map[string]*Request{},
+		bySession: map[string]map[string]*Request{},
+	}
+}
+
+// Track registers a request before it is dispatched to the node. When the
+// node doesn't answer in time the request is removed and a timeout error is
+// replied.
+func (t *Tracker) Track(id string, nodeID models.UUID, command string, timeout time.Duration, reply ReplyFunc) error {
+	return t.TrackSession(id, nodeID, "", command, timeout, reply)
+}
+
+// TrackSession is Track for a request written to a node session, the request
+// fails when that session closes.
+func (t *Tracker) TrackSession(id string, nodeID models.UUID, sessionID string, command string, timeout time.Duration, reply ReplyFunc) error {
+	if id == "" {
+		return ErrEmptyRequestID
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.requests[id]; ok {
+		return fmt.Errorf("%w: %q", ErrDuplicateRequestID, id)
+	}
+
+	now := time.Now()
+	request := &Request{
+		ID:           id,
+		NodeID:       nodeID,
+		SessionID:    sessionID,
+		Command:      command,
+		DispatchedAt: now,
+		Deadline:     now.Add(timeout),
+		reply:        reply,
+		timeout:      timeout,
+	}
+	request.timer = time.AfterFunc(timeout, func() {
+		t.expire(request)
+	})
+	t.requests[id] = request
+	if t.bySession[sessionID] == nil {
+		t.bySession[sessionID] = map[string]*Request{}
+	}
+	t.bySession[sessionID][id] = request
+	return nil
+}
+
+func (t *Tracker) expire(request *Request) {
+	if !t.remove(request) {
+		return
+	}
+	log.Warn("Request timed out", "requestId", request.ID, "nodeId", request.NodeID, "command", request.Command, "dispatchedAt", request.DispatchedAt)
+	request.deliver(&models.ToCloudResponse{
+		RequestError: RequestErrorTimeout,
+	})
+}
+
+func (t *Tracker) remove(request *Request) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if current, ok := t.requests[request.ID]; !ok || current != request {
+		return false
+	}
+	delete(t.requests, request.ID)
+	delete(t.bySession[request.SessionID], request.ID)
+	if len(t.bySession[request.SessionID]) == 0 {
+		delete(t.bySession, request.SessionID)
+	}
+	request.timer.Stop()
+	return true
+}
+
+// Resolve finishes a pending request answered by the node and replies the
+// response. It returns false for unknown or late responses and for responses
+// coming from another node than the request was sent to.
+func (t *Tracker) Resolve(id string, nodeID models.UUID, response *models.ToCloudResponse) bool {
+	t.mu.Lock()
+	request, ok := t.requests[id]
+	t.mu.Unlock()
+	if !ok || request.NodeID != nodeID {
+		return false
+	}
+	if !t.remove(request) {
+		return false
+	}
+	request.deliver(response)
+	return true
+}
+
+// Extend restarts the deadline of a pending request the node reported
+// progress on.
+func (t *Tracker) Extend(id string, nodeID models.UUID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	request, ok := t.requests[id]
+	if !ok || request.NodeID != nodeID {
+		return false
+	}
+	// The timer already fired, the request is timing out
+	if !request.timer.Stop() {
+		return false
+	}
+	request.Deadline = request.extend()
+	return true
+}
+
+// Cancel forgets a pending request without replying, it is used when the
+// request couldn't be dispatched at all.
+func (t *Tracker) Cancel(id string) {
+	t.mu.Lock()
+	request, ok := t.requests[id]
+	t.mu.Unlock()
+	if ok {
+		t.remove(request)
+	}
+}
+
+// FailSession replies an error to every request still pending on the node
+// session, it is called when the session closes. Requests written to a newer
+// session of the same node are left alone.
+func (t *Tracker) FailSession(sessionID string, reason string) int {
+	t.mu.Lock()
+	requests := make([]*Request, 0, len(t.bySession[sessionID]))
+	for _, request := range t.bySession[sessionID] {
+		requests = append(requests, request)
+	}
+	t.mu.Unlock()
+
+	failed := 0
+	for _, request := range requests {
+		if !t.remove(request) {
+			continue
+		}
+		request.deliver(&models.ToCloudResponse{
+			RequestError: reason,
+		})
+		failed++
+	}
+	return failed
+}
+
+func (t *Tracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.requests)
+}
+
+var pending = New()
+
+func Track(id string, nodeID models.UUID, command string, timeout time.Duration, reply ReplyFunc) error {
+	return pending.Track(id, nodeID, command, timeout, reply)
+}
+
+func TrackSession(id string, nodeID models.UUID, sessionID string, command string, timeout time.Duration, reply ReplyFunc) error {
+	return pending.TrackSession(id, nodeID, sessionID, command, timeout, reply)
+}
+
+func Resolve(id string, nodeID models.UUID, response *models.ToCloudResponse) bool {
+	return pending.Resolve(id, nodeID, response)
+}
+
+func Extend(id string, nodeID models.UUID) bool {
+	return pending.Extend(id, nodeID)
+}
+
+func Cancel(id string) {
+	pending.Cancel(id)
+}
+
+func FailSession(sessionID string, reason string) int {
+	return pending.FailSession(sessionID, reason)
+}
@@ -0,0 +1,223 @@
+package tracker
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zarinit-routers/cloud-connector/models"
+)
+
+type replies struct {
+	mu        sync.Mutex
+	responses []*models.ToCloudResponse
+	got       chan struct{}
+}
+
+func newReplies() *replies {
+	return &replies{got: make(chan struct{}, 1000)}
+}
+
+func (r *replies) reply(response *models.ToCloudResponse) {
+	r.mu.Lock()
+	r.responses = append(r.responses, response)
+	r.mu.Unlock()
+	r.got <- struct{}{}
+}
+
+func (r *replies) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.responses)
+}
+
+func (r *replies) wait(t *testing.T) *models.ToCloudResponse {
+	t.Helper()
+	select {
+	case <-r.got:
+	case <-time.After(time.Second):
+		t.Fatal("no reply")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.responses[len(r.responses)-1]
+}
+
+func TestTrack(t *testing.T) {
+	tr := New()
+	node := uuid.New()
+
+	if err := tr.Track("", node, "ping", time.Minute, newReplies().reply); !errors.Is(err, ErrEmptyRequestID) {
+		t.Fatalf("empty id: got %v", err)
+	}
+	if err := tr.Track("a", node, "ping", time.Minute, newReplies().reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Track("a", node, "ping", time.Minute, newReplies().reply); !errors.Is(err, ErrDuplicateRequestID) {
+		t.Fatalf("duplicate id: got %v", err)
+	}
+	if tr.Len() != 1 {
+		t.Fatalf("got %d pending requests", tr.Len())
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tr := New()
+	node := uuid.New()
+	r := newReplies()
+	if err := tr.Track("a", node, "ping", time.Minute, r.reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr.Resolve("a", uuid.New(), &models.ToCloudResponse{}) {
+		t.Fatal("resolved by another node")
+	}
+	if !tr.Resolve("a", node, &models.ToCloudResponse{Data: models.JsonMap{"ok": true}}) {
+		t.Fatal("not resolved")
+	}
+	if tr.Resolve("a", node, &models.ToCloudResponse{}) {
+		t.Fatal("resolved twice")
+	}
+	if response := r.wait(t); response.Data["ok"] != true {
+		t.Fatalf("got %+v", response)
+	}
+	if tr.Len() != 0 {
+		t.Fatalf("got %d pending requests", tr.Len())
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tr := New()
+	node := uuid.New()
+	r := newReplies()
+	if err := tr.Track("a", node, "ping", 10*time.Millisecond, r.reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if response := r.wait(t); response.RequestError != RequestErrorTimeout {
+		t.Fatalf("got %+v", response)
+	}
+	if tr.Resolve("a", node, &models.ToCloudResponse{}) {
+		t.Fatal("late response resolved")
+	}
+	if tr.Extend("a", node) {
+		t.Fatal("expired request extended")
+	}
+}
+
+func TestCancel(t *testing.T) {
+	tr := New()
+	node := uuid.New()
+	r := newReplies()
+	if err := tr.Track("a", node, "ping", 10*time.Millisecond, r.reply); err != nil {
+		t.Fatal(err)
+	}
+
+	tr.Cancel("a")
+	time.Sleep(30 * time.Millisecond)
+	if r.count() != 0 {
+		t.Fatal("cancelled request replied")
+	}
+	if tr.Len() != 0 {
+		t.Fatalf("got %d pending requests", tr.Len())
+	}
+}
+
+func TestExtend(t *testing.T) {
+	tr := New()
+	node := uuid.New()
+	r := newReplies()
+	if err := tr.Track("a", node, "ping", 50*time.Millisecond, r.reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr.Extend("a", uuid.New()) {
+		t.Fatal("extended by another node")
+	}
+	for range 4 {
+		time.Sleep(30 * time.Millisecond)
+		if !tr.Extend("a", node) {
+			t.Fatal("not extended")
+		}
+	}
+	if r.count() != 0 {
+		t.Fatal("extended request timed out")
+	}
+	if response := r.wait(t); response.RequestError != RequestErrorTimeout {
+		t.Fatalf("got %+v", response)
+	}
+}
+
+func TestFailSession(t *testing.T) {
+	tr := New()
+	node := uuid.New()
+	r, newer := newReplies(), newReplies()
+	for _, id := range []string{"a", "b"} {
+		if err := tr.TrackSession(id, node, "old", "ping", time.Minute, r.reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The node reconnected and got a request on its new session
+	if err := tr.TrackSession("c", node, "new", "ping", time.Minute, newer.reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if failed := tr.FailSession("old", RequestErrorNodeDisconnected); failed != 2 {
+		t.Fatalf("failed %d requests", failed)
+	}
+	for range 2 {
+		if response := r.wait(t); response.RequestError != RequestErrorNodeDisconnected {
+			t.Fatalf("got %+v", response)
+		}
+	}
+	if newer.count() != 0 || tr.Len() != 1 {
+		t.Fatal("request of the new session failed")
+	}
+}
+
+// Every request is answered exactly once, whatever answers it first.
+func TestRaces(t *testing.T) {
+	tr := New()
+	node := uuid.New()
+	r := newReplies()
+	const n = 300
+
+	var wg sync.WaitGroup
+	for i := range n {
+		id := uuid.NewString()
+		if err := tr.TrackSession(id, node, "s1", "ping", time.Duration(i%3)*time.Millisecond+time.Millisecond, r.reply); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			tr.Extend(id, node)
+		}()
+		go func() {
+			defer wg.Done()
+			tr.Resolve(id, node, &models.ToCloudResponse{})
+		}()
+		go func() {
+			defer wg.Done()
+			if i%2 == 0 {
+				tr.FailSession("s1", RequestErrorNodeDisconnected)
+			}
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.After(time.Second)
+	for r.count() < n {
+		select {
+		case <-r.got:
+		case <-deadline:
+			t.Fatalf("got %d replies for %d requests", r.count(), n)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if r.count() != n {
+		t.Fatalf("got %d replies for %d requests", r.count(), n)
+	}
+}
@@ -0,0 +1,89 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zarinit-routers/cloud-connector/config"
+)
+
+const (
+	ENV_BLOB_STORE_PATH = "BLOB_STORE_PATH"
+)
+
+var (
+	ErrBadBlobPath = errors.New("path is outside of the blob store")
+)
+
+func getBlobStorePath() string {
+	return config.String(ENV_BLOB_STORE_PATH, "blobs")
+}
+
+// blobPath returns where a blob with the checksum is kept. Blobs are named by
+// their checksum so a file can't change under a transfer being resumed.
+func blobPath(sha string) string {
+	return filepath.Join(getBlobStorePath(), "sha256", sha)
+}
+
+// StoreBlob copies the content to the blob store and returns its checksum
+// and size.
+func StoreBlob(r io.Reader) (string, int64, error) {
+	dir := filepath.Join(getBlobStorePath(), "sha256")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", 0, fmt.Errorf("failed to create blob store: %s", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create blob: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to write blob: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, fmt.Errorf("failed to write blob: %s", err)
+	}
+
+	sha := hex.EncodeToString(hash.Sum(nil))
+	if err := os.Rename(tmp.Name(), blobPath(sha)); err != nil {
+		return "", 0, fmt.Errorf("failed to store blob: %s", err)
+	}
+	return sha, size, nil
+}
+
+// StoreLocalFile stores a file already lying in the blob store directory,
+// the path is relative to BLOB_STORE_PATH.
+func StoreLocalFile(path string) (string, int64, error) {
+	root := getBlobStorePath()
+	full := filepath.Join(root, filepath.Clean("/"+path))
+	rel, err := filepath.Rel(root, full)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "sha256"+string(filepath.Separator)) {
+		return "", 0, fmt.Errorf("%w: %q", ErrBadBlobPath, path)
+	}
+
+	file, err := os.Open(full)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open file: %s", err)
+	}
+	defer file.Close()
+	return StoreBlob(file)
+}
+
+func openBlob(sha string) (*os.File, error) {
+	file, err := os.Open(blobPath(sha))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob %q: %s", sha, err)
+	}
+	return file, nil
+}
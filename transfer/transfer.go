@@ -0,0 +1,354 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/zarinit-routers/cloud-connector/config"
+	"github.com/zarinit-routers/cloud-connector/connections"
+	"github.com/zarinit-routers/cloud-connector/models"
+	"github.com/zarinit-routers/cloud-connector/queue"
+	"github.com/zarinit-routers/cloud-connector/storage/repository"
+)
+
+const (
+	ENV_FILE_CHUNK_SIZE  = "FILE_CHUNK_SIZE"
+	ENV_FILE_ACK_TIMEOUT = "FILE_ACK_TIMEOUT"
+	ENV_FILE_MAX_RETRIES = "FILE_MAX_RETRIES"
+
+	// Progress is saved and reported every that many percent
+	progressStep = 5
+)
+
+var (
+	ErrUnknownTransfer = errors.New("unknown transfer")
+	ErrUnsupported     = errors.New("file transfers are not supported by node")
+)
+
+var (
+	tlog = log.WithPrefix("Transfer")
+
+	mu     sync.Mutex
+	active = map[models.UUID]*transfer{}
+)
+
+func getChunkSize() int {
+	return config.Int(ENV_FILE_CHUNK_SIZE, 64*1024)
+}
+
+func getAckTimeout() time.Duration {
+	return config.Duration(ENV_FILE_ACK_TIMEOUT, time.Minute)
+}
+
+func getMaxRetries() int {
+	return config.Int(ENV_FILE_MAX_RETRIES, 3)
+}
+
+// transfer is a file being sent over the current session of its node.
+type transfer struct {
+	mu       sync.Mutex
+	record   repository.FileTransfer
+	session  *connections.Session
+	file     *os.File
+	offset   int64
+	reported int64
+	retries  int
+	timer    *time.Timer
+	stopped  bool
+}
+
+// Start offers the file to the node, the node answers with the offset it
+// already has so an interrupted transfer continues where it stopped. The
+// handshake of the session must be done, transfers to nodes without file
+// transfer support fail with ErrUnsupported and stay pending.
+func Start(session *connections.Session, record *repository.FileTransfer) error {
+	if !session.Supports(models.CommandFileTransfer) {
+		return ErrUnsupported
+	}
+
+	file, err := openBlob(record.Sha256)
+	if err != nil {
+		fail(session, record, err.Error())
+		return err
+	}
+
+	t := &transfer{
+		record:   *record,
+		session:  session,
+		file:     file,
+		offset:   record.Offset,
+		reported: record.Offset * 100 / max(record.Size, 1) / progressStep,
+	}
+
+	mu.Lock()
+	previous := active[record.ID]
+	active[record.ID] = t
+	mu.Unlock()
+	if previous != nil {
+		previous.stop()
+	}
+
+	if err := repository.UpdateFileTransfer(record.ID, repository.TransferStateSending, t.offset, ""); err != nil {
+		tlog.Error("Failed to update transfer", "error", err, "transferId", record.ID)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tlog.Info("Offering file", "transferId", record.ID, "nodeId", session.NodeID(), "name", record.Name, "size", record.Size)
+	return t.offer()
+}
+
+// Resume starts every unfinished transfer of a newly connected node.
+func Resume(session *connections.Session) {
+	records, err := repository.GetUnfinishedFileTransfers(session.NodeID())
+	if err != nil {
+		tlog.Error("Failed get unfinished transfers", "error", err, "nodeId", session.NodeID())
+		return
+	}
+	for _, record := range records {
+		err := Start(session, &record)
+		if errors.Is(err, ErrUnsupported) {
+			tlog.Warn("Node doesn't support file transfers, leaving them pending", "nodeId", session.NodeID(), "transfers", len(records))
+			return
+		}
+		if err != nil {
+			tlog.Error("Failed to resume transfer", "error", err, "transferId", record.ID)
+		}
+	}
+}
+
+// Suspend stops transfers of a disconnected session, they are resumed on the
+// next connection of the node.
+func Suspend(session *connections.Session) {
+	mu.Lock()
+	var suspended []*transfer
+	for id, t := range active {
+		if t.session == session {
+			delete(active, id)
+			suspended = append(suspended, t)
+		}
+	}
+	mu.Unlock()
+
+	for _, t := range suspended {
+		t.stop()
+		t.mu.Lock()
+		if err := repository.UpdateFileTransfer(t.record.ID, repository.TransferStatePending, t.offset, ""); err != nil {
+			tlog.Error("Failed to update transfer", "error", err, "transferId", t.record.ID)
+		}
+		t.mu.Unlock()
+		tlog.Warn("Transfer suspended", "transferId", t.record.ID, "nodeId", session.NodeID(), "offset", t.offset)
+	}
+}
+
+// Handle processes a file transfer message of the node.
+func Handle(session *connections.Session, message *models.FromNodeFile) error {
+	id, err := uuid.Parse(message.TransferID)
+	if err != nil {
+		return fmt.Errorf("bad transfer id %q: %s", message.TransferID, err)
+	}
+	mu.Lock()
+	t, ok := active[id]
+	mu.Unlock()
+	if !ok || t.session != session {
+		return fmt.Errorf("%w %q", ErrUnknownTransfer, message.TransferID)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return nil
+	}
+
+	switch message.Type {
+	case models.MessageTypeFileAccept, models.MessageTypeFileAck:
+		if message.Offset > t.record.Size {
+			t.finish(repository.TransferStateFailed, fmt.Sprintf("node acknowledged offset %d past the end of the file", message.Offset))
+			return nil
+		}
+		if message.Offset > t.offset {
+			t.retries = 0
+		} else if message.Type == models.MessageTypeFileAck {
+			// The node asks for the chunk again
+			t.retries++
+			if t.retries > getMaxRetries() {
+				t.finish(repository.TransferStateFailed, fmt.Sprintf("node rejected the chunk at offset %d too many times", message.Offset))
+				return nil
+			}
+		}
+		t.offset = message.Offset
+		t.progress()
+		if t.offset == t.record.Size {
+			return t.complete()
+		}
+		return t.sendChunk()
+	case models.MessageTypeFileDone:
+		t.finish(repository.TransferStateCompleted, "")
+	case models.MessageTypeFileError:
+		t.finish(repository.TransferStateFailed, message.Error)
+	}
+	return nil
+}
+
+func (t *transfer) offer() error {
+	t.watch()
+	return t.session.WriteMessage(&models.ToNodeFile{
+		Type:       models.MessageTypeFileOffer,
+		TransferID: t.record.ID.String(),
+		Name:       t.record.Name,
+		Target:     t.record.Target,
+		Size:       t.record.Size,
+		ChunkSize:  getChunkSize(),
+		Sha256:     t.record.Sha256,
+		Offset:     t.offset,
+	})
+}
+
+func (t *transfer) sendChunk() error {
+	data := make([]byte, min(int64(getChunkSize()), t.record.Size-t.offset))
+	if _, err := t.file.ReadAt(data, t.offset); err != nil && !errors.Is(err, io.EOF) {
+		t.finish(repository.TransferStateFailed, fmt.Sprintf("failed to read blob: %s", err))
+		return err
+	}
+	sum := sha256.Sum256(data)
+
+	t.watch()
+	return t.session.WriteMessage(&models.ToNodeFile{
+		Type:       models.MessageTypeFileChunk,
+		TransferID: t.record.ID.String(),
+		Offset:     t.offset,
+		Sha256:     hex.EncodeToString(sum[:]),
+		Data:       data,
+	})
+}
+
+func (t *transfer) complete() error {
+	t.watch()
+	return t.session.WriteMessage(&models.ToNodeFile{
+		Type:       models.MessageTypeFileComplete,
+		TransferID: t.record.ID.String(),
+		Size:       t.record.Size,
+		Sha256:     t.record.Sha256,
+		Offset:     t.offset,
+	})
+}
+
+// watch restarts the acknowledgement timer. When the node stays silent the
+// file is offered again, the node answers with the offset it really has.
+func (t *transfer) watch() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = time.AfterFunc(getAckTimeout(), func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.stopped {
+			return
+		}
+		t.retries++
+		if t.retries > getMaxRetries() {
+			t.finish(repository.TransferStateFailed, "node stopped acknowledging chunks")
+			return
+		}
+		tlog.Warn("Transfer is not acknowledged, offering file again", "transferId", t.record.ID, "offset", t.offset, "retry", t.retries)
+		if err := t.offer(); err != nil {
+			tlog.Error("Failed to offer file", "error", err, "transferId", t.record.ID)
+		}
+	})
+}
+
+// progress saves and reports the offset every progress step.
+func (t *transfer) progress() {
+	step := t.offset * 100 / max(t.record.Size, 1) / progressStep
+	if step <= t.reported {
+		return
+	}
+	t.reported = step
+	if err := repository.UpdateFileTransfer(t.record.ID, repository.TransferStateSending, t.offset, ""); err != nil {
+		tlog.Error("Failed to update transfer", "error", err, "transferId", t.record.ID)
+	}
+	publish(t.session, &t.record, models.EventFileProgress, t.offset, "")
+}
+
+// finish stores the final state and forgets the transfer, the lock must be
+// held.
+func (t *transfer) finish(state string, errorMessage string) {
+	t.stopLocked()
+	mu.Lock()
+	if active[t.record.ID] == t {
+		delete(active, t.record.ID)
+	}
+	mu.Unlock()
+
+	if err := repository.UpdateFileTransfer(t.record.ID, state, t.offset, errorMessage); err != nil {
+		tlog.Error("Failed to update transfer", "error", err, "transferId", t.record.ID)
+	}
+	event := models.EventFileCompleted
+	if state == repository.TransferStateFailed {
+		event = models.EventFileFailed
+		tlog.Error("Transfer failed", "transferId", t.record.ID, "nodeId", t.session.NodeID(), "error", errorMessage)
+	} else {
+		tlog.Info("Transfer completed", "transferId", t.record.ID, "nodeId", t.session.NodeID())
+	}
+	publish(t.session, &t.record, event, t.offset, errorMessage)
+}
+
+func (t *transfer) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopLocked()
+}
+
+func (t *transfer) stopLocked() {
+	if t.stopped {
+		return
+	}
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.file.Close()
+}
+
+// fail marks a transfer that couldn't even be started.
+func fail(session *connections.Session, record *repository.FileTransfer, errorMessage string) {
+	if err := repository.UpdateFileTransfer(record.ID, repository.TransferStateFailed, record.Offset, errorMessage); err != nil {
+		tlog.Error("Failed to update transfer", "error", err, "transferId", record.ID)
+	}
+	publish(session, record, models.EventFileFailed, record.Offset, errorMessage)
+}
+
+func publish(session *connections.Session, record *repository.FileTransfer, event string, offset int64, errorMessage string) {
+	now := time.Now()
+	data := models.JsonMap{
+		"transferId": record.ID.String(),
+		"name":       record.Name,
+		"target":     record.Target,
+		"sha256":     record.Sha256,
+		"size":       record.Size,
+		"offset":     offset,
+		"percent":    offset * 100 / max(record.Size, 1),
+	}
+	if errorMessage != "" {
+		data["error"] = errorMessage
+	}
+	err := queue.PublishNodeEvent(&models.ToCloudEvent{
+		Event:          event,
+		NodeID:         session.NodeID(),
+		OrganizationID: session.OrganizationID(),
+		Timestamp:      now,
+		ReceivedAt:     now,
+		Data:           data,
+	})
+	if err != nil {
+		tlog.Error("Failed to publish transfer event", "error", err, "transferId", record.ID, "event", event)
+	}
+}
@@ -0,0 +1,325 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/zarinit-routers/cloud-connector/config"
+	"github.com/zarinit-routers/cloud-connector/connections"
+	"github.com/zarinit-routers/cloud-connector/models"
+	"github.com/zarinit-routers/cloud-connector/storage/repository"
+)
+
+const (
+	ENV_TUNNEL_OPEN_TIMEOUT     = "TUNNEL_OPEN_TIMEOUT"
+	ENV_TUNNEL_IDLE_TIMEOUT     = "TUNNEL_IDLE_TIMEOUT"
+	ENV_TUNNEL_WRITE_TIMEOUT    = "TUNNEL_WRITE_TIMEOUT"
+	ENV_TUNNEL_MAX_PER_NODE     = "TUNNEL_MAX_PER_NODE"
+	ENV_TUNNEL_MAX_OUT_OF_ORDER = "TUNNEL_MAX_OUT_OF_ORDER"
+)
+
+var (
+	ErrUnknownTunnel = errors.New("unknown tunnel")
+)
+
+var (
+	tlog = log.WithPrefix("Tunnel")
+
+	mu      sync.Mutex
+	tunnels = map[models.UUID]*Tunnel{}
+)
+
+func getOpenTimeout() time.Duration {
+	return config.Duration(ENV_TUNNEL_OPEN_TIMEOUT, 15*time.Second)
+}
+
+func getIdleTimeout() time.Duration {
+	return config.Duration(ENV_TUNNEL_IDLE_TIMEOUT, 10*time.Minute)
+}
+
+func getWriteTimeout() time.Duration {
+	return config.Duration(ENV_TUNNEL_WRITE_TIMEOUT, 10*time.Second)
+}
+
+func getMaxPerNode() int {
+	return config.Int(ENV_TUNNEL_MAX_PER_NODE, 4)
+}
+
+func getMaxOutOfOrder() int {
+	return config.Int(ENV_TUNNEL_MAX_OUT_OF_ORDER, 64)
+}
+
+// Options describe a tunnel to open and who opens it.
+type Options struct {
+	Kind string
+	Host string
+	Port int
+
+	OrganizationID models.UUID
+	UserID         models.UUID
+	ClientAddress  string
+	UserAgent      string
+}
+
+func (o *Options) target() string {
+	if o.Kind == models.TunnelKindShell {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", o.Host, o.Port)
+}
+
+// Tunnel relays a client websocket to a stream opened by the node.
+type Tunnel struct {
+	ID uuid.UUID
+
+	session *connections.Session
+	client  *websocket.Conn
+
+	opened   chan struct{}
+	openOnce sync.Once
+	done     chan struct{}
+	doneOnce sync.Once
+
+	// mu keeps node frames in order while they are written to the client
+	mu      sync.Mutex
+	nextSeq int
+	pending map[int][]byte
+	// Only touched by the client reader
+	outSeq int
+
+	lastActivity  atomic.Int64
+	bytesToNode   atomic.Int64
+	bytesFromNode atomic.Int64
+}
+
+// Serve opens a tunnel on the node and relays the client websocket to it
+// until either side closes it, the node disconnects or the tunnel is idle
+// for too long. Every tunnel is recorded in the audit table.
+func Serve(session *connections.Session, client *websocket.Conn, opts Options) {
+	t := &Tunnel{
+		ID:      uuid.New(),
+		session: session,
+		client:  client,
+		opened:  make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: map[int][]byte{},
+	}
+	t.touch()
+
+	if !register(t) {
+		tlog.Warn("Too many tunnels to node", "nodeId", session.NodeID())
+		closeClient(client, websocket.ClosePolicyViolation, "too many tunnels to node")
+		return
+	}
+
+	_, err := repository.NewTunnelSession(t.ID, session.NodeID(), opts.OrganizationID, opts.UserID, opts.Kind, opts.target(), opts.ClientAddress, opts.UserAgent)
+	if err != nil {
+		unregister(t)
+		tlog.Error("Failed to audit tunnel, not opening it", "error", err, "nodeId", session.NodeID())
+		closeClient(client, websocket.CloseInternalServerErr, "failed to audit tunnel")
+		return
+	}
+	tlog.Info("Opening tunnel", "tunnelId", t.ID, "nodeId", session.NodeID(), "kind", opts.Kind, "target", opts.target(), "client", opts.ClientAddress)
+
+	err = session.WriteMessage(&models.TunnelMessage{
+		Type:     models.MessageTypeTunnelOpen,
+		TunnelID: t.ID.String(),
+		Kind:     opts.Kind,
+		Host:     opts.Host,
+		Port:     opts.Port,
+	})
+	if err != nil {
+		t.close(websocket.CloseInternalServerErr, fmt.Sprintf("failed to open: %s", err), false)
+		return
+	}
+
+	select {
+	case <-t.opened:
+	case <-t.done:
+		return
+	case <-session.Done():
+		t.close(websocket.CloseGoingAway, "node disconnected", false)
+		return
+	case <-time.After(getOpenTimeout()):
+		t.close(websocket.CloseTryAgainLater, "node didn't open the tunnel in time", true)
+		return
+	}
+	tlog.Info("Tunnel opened", "tunnelId", t.ID, "nodeId", session.NodeID())
+
+	go t.watch()
+	t.readClient()
+}
+
+// Handle processes a tunnel frame of the node.
+func Handle(session *connections.Session, message *models.TunnelMessage) error {
+	id, err := uuid.Parse(message.TunnelID)
+	if err != nil {
+		return fmt.Errorf("bad tunnel id %q: %s", message.TunnelID, err)
+	}
+	mu.Lock()
+	t, ok := tunnels[id]
+	mu.Unlock()
+	if !ok || t.session != session {
+		return fmt.Errorf("%w %q", ErrUnknownTunnel, message.TunnelID)
+	}
+
+	switch message.Type {
+	case models.MessageTypeTunnelOpened:
+		t.openOnce.Do(func() {
+			close(t.opened)
+		})
+	case models.MessageTypeTunnelData:
+		t.deliver(message.Seq, message.Data)
+	case models.MessageTypeTunnelClose:
+		reason := "closed by node"
+		if message.Reason != "" {
+			reason = fmt.Sprintf("closed by node: %s", message.Reason)
+		}
+		t.close(websocket.CloseNormalClosure, reason, false)
+	}
+	return nil
+}
+
+func register(t *Tunnel) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	count := 0
+	for _, other := range tunnels {
+		if other.session.NodeID() == t.session.NodeID() {
+			count++
+		}
+	}
+	if count >= getMaxPerNode() {
+		return false
+	}
+	tunnels[t.ID] = t
+	return true
+}
+
+func unregister(t *Tunnel) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(tunnels, t.ID)
+}
+
+func (t *Tunnel) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// readClient forwards client frames to the node until the client goes away.
+func (t *Tunnel) readClient() {
+	for {
+		_, data, err := t.client.ReadMessage()
+		if err != nil {
+			t.close(websocket.CloseNormalClosure, "closed by client", true)
+			return
+		}
+		t.touch()
+		err = t.session.WriteMessage(&models.TunnelMessage{
+			Type:     models.MessageTypeTunnelData,
+			TunnelID: t.ID.String(),
+			Seq:      t.outSeq,
+			Data:     data,
+		})
+		if err != nil {
+			t.close(websocket.CloseGoingAway, fmt.Sprintf("failed to write to node: %s", err), false)
+			return
+		}
+		t.outSeq++
+		t.bytesToNode.Add(int64(len(data)))
+	}
+}
+
+// deliver writes node frames to the client in sequence order.
+func (t *Tunnel) deliver(seq int, data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if seq < t.nextSeq {
+		return
+	}
+	t.pending[seq] = data
+	if len(t.pending) > getMaxOutOfOrder() {
+		go t.close(websocket.CloseInternalServerErr, "too many frames out of order", true)
+		return
+	}
+	t.touch()
+
+	for {
+		data, ok := t.pending[t.nextSeq]
+		if !ok {
+			return
+		}
+		delete(t.pending, t.nextSeq)
+		t.nextSeq++
+		t.client.SetWriteDeadline(time.Now().Add(getWriteTimeout()))
+		if err := t.client.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			go t.close(websocket.CloseNormalClosure, fmt.Sprintf("failed to write to client: %s", err), true)
+			return
+		}
+		t.bytesFromNode.Add(int64(len(data)))
+	}
+}
+
+// watch closes the tunnel when the node disconnects or nothing goes through
+// it for the idle timeout.
+func (t *Tunnel) watch() {
+	idle := getIdleTimeout()
+	ticker := time.NewTicker(max(idle/10, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-t.session.Done():
+			t.close(websocket.CloseGoingAway, "node disconnected", false)
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, t.lastActivity.Load())) > idle {
+				t.close(websocket.CloseNormalClosure, "idle timeout", true)
+				return
+			}
+		}
+	}
+}
+
+// close tears the tunnel down once and finishes its audit record. The node is
+// told to close its side unless it was the one closing.
+func (t *Tunnel) close(code int, reason string, notifyNode bool) {
+	t.doneOnce.Do(func() {
+		close(t.done)
+		unregister(t)
+
+		if notifyNode {
+			err := t.session.WriteMessage(&models.TunnelMessage{
+				Type:     models.MessageTypeTunnelClose,
+				TunnelID: t.ID.String(),
+				Reason:   reason,
+			})
+			if err != nil {
+				tlog.Warn("Failed to close tunnel on node", "error", err, "tunnelId", t.ID)
+			}
+		}
+		closeClient(t.client, code, reason)
+
+		if err := repository.CloseTunnelSession(t.ID, t.bytesToNode.Load(), t.bytesFromNode.Load(), reason); err != nil {
+			tlog.Error("Failed to audit tunnel close", "error", err, "tunnelId", t.ID)
+		}
+		tlog.Info("Tunnel closed", "tunnelId", t.ID, "nodeId", t.session.NodeID(), "reason", reason, "bytesToNode", t.bytesToNode.Load(), "bytesFromNode", t.bytesFromNode.Load())
+	})
+}
+
+func closeClient(client *websocket.Conn, code int, reason string) {
+	// Control frames are limited to 125 bytes
+	if len(reason) > 120 {
+		reason = reason[:120]
+	}
+	message := websocket.FormatCloseMessage(code, reason)
+	client.WriteControl(websocket.CloseMessage, message, time.Now().Add(getWriteTimeout()))
+	client.Close()
+}